@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 )
 
 // A File holds on-disk storage.
@@ -139,6 +141,9 @@ func (dec decoder) Decode(x interface{}) error {
 	if err != nil {
 		return err
 	}
+	if len(names) > 0 && dec.DestDir == "" {
+		return errors.New("filemarshal: files sent where none are taken")
+	}
 	files := make(map[string][]*File)
 	typeapply.Do(func(f *File) {
 		if f != nil && f.CurrentName != "" { // We're only concerned with the destination
@@ -156,6 +161,9 @@ func (dec decoder) Decode(x interface{}) error {
 			if f == nil {
 				return errors.New("file not found in manifest")
 			}
+			if err = CheckName(f.DestName); err != nil {
+				return err
+			}
 			destname := dec.DestDir + f.DestName
 
 			switch {
@@ -173,6 +181,9 @@ func (dec decoder) Decode(x interface{}) error {
 					err = nil
 				}
 
+				if err = dec.checkLink(dir, f.SymlinkTarget); err != nil {
+					return errors.New(f.DestName + ": " + err.Error())
+				}
 				if f.SymlinkTarget[0] == '/' {
 					// if the link is absolute we glom on our root prefix
 					f.SymlinkTarget = dec.DestDir + f.SymlinkTarget
@@ -227,6 +238,61 @@ func (dec decoder) Decode(x interface{}) error {
 	return nil
 }
 
+// CheckName says whether a DestName keeps its file under the directory
+// it is decoded into: it must start with a / and have no .. in it.
+func CheckName(name string) error {
+	if !strings.HasPrefix(name, "/") {
+		return errors.New(name + ": not an absolute path")
+	}
+	for _, e := range strings.Split(name, "/") {
+		if e == ".." {
+			return errors.New(name + ": has .. in it")
+		}
+	}
+	return nil
+}
+
+// checkLink says whether a symlink to target, in the directory dir, points
+// under DestDir. An absolute target does, since DestDir goes in front of
+// it, as long as it has no .. in it. A relative one may start with as
+// many .. as dir is deep under DestDir, following any links, but have
+// none after that. So every link under DestDir points under it, and
+// nothing written through one can end up anywhere else.
+func (dec decoder) checkLink(dir, target string) error {
+	if target == "" {
+		return errors.New("empty symlink")
+	}
+	root, err := filepath.EvalSymlinks(dec.DestDir)
+	if err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if real != root && !strings.HasPrefix(real, root+"/") {
+		return errors.New(dir + " is not under " + dec.DestDir)
+	}
+	depth := len(strings.Split(real[len(root):], "/")) - 1
+	up, down := 0, false
+	for _, e := range strings.Split(target, "/") {
+		switch e {
+		case "", ".":
+		case "..":
+			if down || target[0] == '/' {
+				return errors.New("link to " + target + " has .. in it")
+			}
+			up++
+		default:
+			down = true
+		}
+	}
+	if up > depth {
+		return errors.New("link to " + target + " points above " + dec.DestDir)
+	}
+	return nil
+}
+
 type nullWriter struct{}
 
 func (nullWriter) Write(buf []byte) (int, error) {
@@ -250,6 +316,7 @@ func NewEncoder(enc Encoder) Encoder {
 // file holding the same data.
 // I don't think including the root in the constructor is a great idea,
 // but it's the best we've got right now.
+// A decoder with no root takes no files: Decode fails if any are sent.
 func NewDecoder(dec Decoder, root string) Decoder {
 	return decoder{dec, root}
 }
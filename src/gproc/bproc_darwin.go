@@ -9,6 +9,30 @@
 
 package main
 
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+/* the ioctls that get and set a terminal's modes */
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
+
+/* the resources "gproc e -rlimit" knows about; syscall has no RLIMIT_NPROC */
+var rlimitResources = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"nproc":  7,
+}
+
 func privatemount(path string) int {
 	log_error("privatemount called on OSX")
 	return -1
@@ -19,26 +43,38 @@ func unshare() int {
 	return -1
 }
 
-/* no on OSX? */
-func ucred(fd int) (pid, uid, gid int) {
-	/*
-		var length [1]int
-		creds := make([]int, 3)
-		ucred := make([]uintptr, 6)
-		length[0] = 12
-		ucred[0] = syscall.SOL_SOCKET
-		ucred[1] = syscall.SO_PEERCRED
-		ucred[2] = uintptr(unsafe.Pointer(&creds[0]))
-		ucred[3] = uintptr(unsafe.Pointer(&length[0]))
-		_, _, e1 := syscall.Syscall(102, 15, uintptr(unsafe.Pointer(&ucred[0])), 0)
-
-		if e1 < 0 {
-			if *DebugLevel > 2 {
-				log.Printf("%v %v\n", fd, e1)
-			}
-			return -1,-1,-1
-		}
-		return creds[0], creds[1], creds[2]
-	*/
-	return 0, 0, 0
+/* no SO_PEERCRED on OSX */
+func ucred(c net.Conn) (uid, gid int, groups []int, err error) {
+	return 0, 0, nil, errors.New("no peer credentials on OSX")
+}
+
+/* no cgroups on OSX */
+func newCgroup(parent, name string, req *StartReq) (*cgroup, error) {
+	return nil, errors.New("no cgroups on OSX")
+}
+
+func joinCgroup(dir string) error {
+	return errors.New("no cgroups on OSX")
+}
+
+func (cg *cgroup) Kill() {}
+
+func (cg *cgroup) Usage() (memPeak int64, cpu time.Duration) {
+	return
+}
+
+func (cg *cgroup) OOMKilled() bool {
+	return false
+}
+
+func (cg *cgroup) Remove() {}
+
+/* slaves run on Linux; a Mac only needs its own terminal */
+func openPty() (ptm, pts *os.File, err error) {
+	return nil, nil, errors.New("no pseudo-terminals for jobs on OSX")
+}
+
+/* nor does a Mac need to say how much memory it has */
+func memTotal() uint64 {
+	return 0
 }
@@ -10,7 +10,15 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -18,6 +26,22 @@ const (
 	linuxhack = 0xc0ed0000
 )
 
+/* the ioctls that get and set a terminal's modes */
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
+
+/* the resources "gproc e -rlimit" knows about; syscall has no RLIMIT_NPROC */
+var rlimitResources = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"nproc":  6,
+}
+
 func privatemount(pathbase string) int {
 	path := []byte(pathbase)
 	none := []byte("none")
@@ -36,3 +60,184 @@ func unshare() int {
 	_, _, syscallerr := syscall.Syscall(syscall.SYS_UNSHARE, uintptr(0x00020000), uintptr(0), uintptr(0))
 	return int(syscallerr)
 }
+
+/*
+ * ucred returns the credentials of the process at the other end of a
+ * Unix domain socket, as the kernel has them: the supplementary groups
+ * come from /proc, and if the process has gone already it gets none.
+ */
+func ucred(c net.Conn) (uid, gid int, groups []int, err error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return 0, 0, nil, errors.New("not a Unix domain socket")
+	}
+	f, err := uc.File()
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	cred, err := syscall.GetsockoptUcred(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return
+	}
+	uid, gid = int(cred.Uid), int(cred.Gid)
+	b, perr := ioutil.ReadFile(fmt.Sprint("/proc/", cred.Pid, "/status"))
+	if perr != nil {
+		log_info("ucred: ", perr)
+		return
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(l, "Groups:") {
+			continue
+		}
+		for _, g := range strings.Fields(l[len("Groups:"):]) {
+			if n, err := strconv.Atoi(g); err == nil {
+				groups = append(groups, n)
+			}
+		}
+	}
+	return
+}
+
+/*
+ * cgroup v2. The parent has to be on the unified hierarchy and ours to
+ * write; we turn on the controllers we need in it as we go.
+ */
+func newCgroup(parent, name string, req *StartReq) (*cgroup, error) {
+	if parent == "" {
+		return nil, errors.New("this node has no -cgroup to put the job in")
+	}
+	for _, c := range []string{"+memory", "+cpu", "+pids"} {
+		/* fails harmlessly if it is on already, or not there at all */
+		ioutil.WriteFile(parent+"/cgroup.subtree_control", []byte(c), 0644)
+	}
+	cg := &cgroup{dir: parent + "/" + name}
+	if err := os.Mkdir(cg.dir, 0755); err != nil {
+		return nil, err
+	}
+	limits := [][2]string{}
+	if req.MemoryMax > 0 {
+		limits = append(limits, [2]string{"memory.max", fmt.Sprint(req.MemoryMax)})
+	}
+	if req.Cpus > 0 {
+		limits = append(limits, [2]string{"cpu.max", fmt.Sprint(int64(req.Cpus*100000), " 100000")})
+	}
+	if req.PidsMax > 0 {
+		limits = append(limits, [2]string{"pids.max", fmt.Sprint(req.PidsMax)})
+	}
+	for _, l := range limits {
+		if err := ioutil.WriteFile(cg.dir+"/"+l[0], []byte(l[1]), 0644); err != nil {
+			cg.Remove()
+			return nil, errors.New("cgroup " + l[0] + ": " + err.Error())
+		}
+	}
+	if req.MemoryMax > 0 {
+		/* no swapping our way past the limit, if there is swap to speak of */
+		ioutil.WriteFile(cg.dir+"/memory.swap.max", []byte("0"), 0644)
+	}
+	return cg, nil
+}
+
+/* joinCgroup moves us into the cgroup in 'dir'. */
+func joinCgroup(dir string) error {
+	return ioutil.WriteFile(dir+"/cgroup.procs", []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+/*
+ * Kill kills everything in the cgroup and waits, for a while, for it to
+ * be gone. Kernels before 5.14 have no cgroup.kill, so there we kill the
+ * processes one at a time until no more turn up.
+ */
+func (cg *cgroup) Kill() {
+	useKill := ioutil.WriteFile(cg.dir+"/cgroup.kill", []byte("1"), 0644) == nil
+	for tries := 0; tries < 100; tries++ {
+		b, err := ioutil.ReadFile(cg.dir + "/cgroup.procs")
+		if err != nil || len(b) == 0 {
+			return
+		}
+		if !useKill {
+			for _, pid := range strings.Fields(string(b)) {
+				if n, err := strconv.Atoi(pid); err == nil {
+					syscall.Kill(n, syscall.SIGKILL)
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log_info("cgroup: ", cg.dir, " will not die")
+}
+
+/*
+ * Usage returns the peak memory and the CPU time of everything that ran
+ * in the cgroup. Kernels before 5.19 do not keep memory.peak.
+ */
+func (cg *cgroup) Usage() (memPeak int64, cpu time.Duration) {
+	if b, err := ioutil.ReadFile(cg.dir + "/memory.peak"); err == nil {
+		memPeak, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+	if usec, ok := cg.stat("cpu.stat", "usage_usec"); ok {
+		cpu = time.Duration(usec) * time.Microsecond
+	}
+	return
+}
+
+/* OOMKilled says whether anything in the cgroup was killed for going over memory.max. */
+func (cg *cgroup) OOMKilled() bool {
+	n, _ := cg.stat("memory.events", "oom_kill")
+	return n > 0
+}
+
+/* stat reads one "key value" line of one of the cgroup's files. */
+func (cg *cgroup) stat(file, key string) (int64, bool) {
+	b, err := ioutil.ReadFile(cg.dir + "/" + file)
+	if err != nil {
+		return 0, false
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		f := strings.Fields(l)
+		if len(f) == 2 && f[0] == key {
+			n, err := strconv.ParseInt(f[1], 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+func (cg *cgroup) Remove() {
+	if err := os.Remove(cg.dir); err != nil {
+		log_info("cgroup: ", err)
+	}
+}
+
+/*
+ * openPty opens a new pseudo-terminal, returning the master side, which
+ * we keep, and the slave side, for the program.
+ */
+func openPty() (ptm, pts *os.File, err error) {
+	ptm, err = os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	var n uint32
+	if err = ioctl(ptm, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err == nil {
+		err = ioctl(ptm, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err == nil {
+		pts, err = os.OpenFile(fmt.Sprint("/dev/pts/", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	return ptm, pts, nil
+}
+
+/* memTotal is how much memory the machine has, in bytes. */
+func memTotal() uint64 {
+	var si syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&si); err != nil {
+		return 0
+	}
+	return uint64(si.Totalram) * uint64(si.Unit)
+}
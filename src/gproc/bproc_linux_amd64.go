@@ -1,33 +0,0 @@
-/*
- * gproc, a Go reimplementation of the LANL version of bproc and the LANL XCPU software. 
- * 
- * This software is released under the GNU Lesser General Public License, version 2, incorporated herein by reference. 
- *
- * Copyright (2010) Sandia Corporation. Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation, 
- * the U.S. Government retains certain rights in this software.
- */
-
-package main
-
-import (
-	"syscall"
-	"unsafe"
-)
-
-func ucred(fd int) (pid, uid, gid int) {
-	var length [1]int
-	creds := make([]int, 3)
-	ucred := make([]uintptr, 6)
-	length[0] = 12
-	ucred[0] = syscall.SOL_SOCKET
-	ucred[1] = syscall.SO_PEERCRED
-	ucred[2] = uintptr(unsafe.Pointer(&creds[0]))
-	ucred[3] = uintptr(unsafe.Pointer(&length[0]))
-	_, _, e1 := syscall.Syscall(102, 15, uintptr(unsafe.Pointer(&ucred[0])), 0)
-
-	if e1 < 0 {
-		log_info("%v %v", fd, e1)
-		return -1, -1, -1
-	}
-	return creds[0], creds[1], creds[2]
-}
@@ -9,12 +9,7 @@
 
 package main
 
-import (
-	"syscall"
-	"unsafe"
-)
-
-var errors = []string{
+var errnoNames = []string{
 	7:   "argument list too long",
 	13:  "permission denied",
 	98:  "address already in use",
@@ -145,21 +140,3 @@ var errors = []string{
 	18:  "invalid cross-device link",
 	54:  "exchange full",
 }
-
-func ucred(fd int) (pid, uid, gid int) {
-	var length [1]int
-	creds := make([]int, 3)
-	ucred := make([]uintptr, 6)
-	length[0] = 12
-	ucred[0] = syscall.SOL_SOCKET
-	ucred[1] = syscall.SO_PEERCRED
-	ucred[2] = uintptr(unsafe.Pointer(&creds[0]))
-	ucred[3] = uintptr(unsafe.Pointer(&length[0]))
-	_, _, e1 := syscall.Syscall(102, 15, uintptr(unsafe.Pointer(&ucred[0])), 0)
-
-	if e1 < 0 {
-		log_info("%v %v\n", fd, e1)
-		return -1, -1, -1
-	}
-	return creds[0], creds[1], creds[2]
-}
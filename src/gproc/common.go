@@ -11,16 +11,24 @@ package main
 
 import (
 	"bitbucket.org/floren/gproc/src/filemarshal"
+	"bitbucket.org/floren/gproc/src/nodespec"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type SlaveResp struct {
@@ -34,6 +42,8 @@ func (s SlaveResp) String() string {
 type Resp struct {
 	NumNodes int
 	Msg      string
+	JobId    int
+	Nodes    string /* the nodes a job runs on, for "gproc e" to tell its user when the master picked them */
 }
 
 func (r Resp) String() string {
@@ -43,6 +53,12 @@ func (r Resp) String() string {
 	return string(r.Msg)
 }
 
+/* nodeList is the master's answer to "gproc e -n": the nodes a node list names, in rank order, and their addresses and host names. */
+type nodeList struct {
+	Ids, Addrs, Hosts []string
+	Msg               string
+}
+
 type SetDebugLevel struct {
 	level int
 }
@@ -76,8 +92,24 @@ type vitalData struct {
 	ParentAddr string
 	ServerAddr string
 	Id         string
+	Hostname   string
+	Labels     map[string]string
 	Nodes      []string
 	Exceptlist map[string]bool
+	Key        string /* what a slave wants to hear before it takes a job; see newKey */
+}
+
+/*
+ * A nodeInfo is what a node knows about one of its sub-nodes, and that
+ * node's own sub-nodes in turn. Each slave keeps its parent up to date
+ * with the nodeInfo of its sub-nodes, so the master has the whole tree.
+ */
+type nodeInfo struct {
+	Id       string
+	Addr     string
+	Hostname string
+	Labels   map[string]string
+	Children []nodeInfo
 }
 
 /* a StartReq is a description of what to run and where to run it.
@@ -104,23 +136,96 @@ type StartReq struct {
 	ThisNode        bool
 	LocalBin        bool
 	Args            []string
-	Env             []string
+	Env             []string /* what -export-all and -export pass on, as it is */
+	SetEnv          []string /* the -env settings, laid over Env once each node has filled in their placeholders */
 	LibList         []string
 	Path            string
 	Lfam, Lserver   string
 	BytesToTransfer int64
-	Uid, Gid        int
-	Cmds            []*cmdToExec
+	/* Who the job runs as. The master fills these in from the credentials
+	 * of the client's connection; whatever the client sent is ignored.
+	 */
+	Uid, Gid int
+	Groups   []int
+	Cmds     []*cmdToExec
 	/* testing: The master and worker nodes, given a list, will take the head
 	 * of the list, and send the rest of the list of Peers on to the next victim. 
 	 * this will result in a chain of delegations. 
 	 */
 	PeerGroupSize int
 	Cwd           string
+	Subdir        string /* -cwd: where under Cwd to run, once each node has filled in its placeholders */
+	/* Who gets our stdin: "all" (or empty), "none", or a single node id. */
+	Stdin string
+	/* The node id of whoever sent this request; empty from the master.
+	 * A node's full id is its parent's id and its own, e.g. 3/5.
+	 */
+	ParentId string
+	/* The job this request belongs to, as numbered by the master */
+	JobId int
+	/* Every node of the job, in rank order, and its address */
+	Ranks, RankAddrs []string
+	/* Run the job without the client: the master keeps its output */
+	Detach bool
+	/* Tear the whole job down as soon as one node fails */
+	FailFast bool
+	/* Start the program nowhere until the files are in place everywhere */
+	Staged bool
+	/* Give the program a terminal, of this size if not zero */
+	Tty        bool
+	Rows, Cols int
+	/* An MPMD job runs a different program on each group of nodes; Nodes
+	 * is then all of them, and Args and Cmds are each group's business.
+	 */
+	Mpmd []mpmdGroup
+	/* Wall-clock limit for the program on each node, if not zero. When it
+	 * runs out the program gets SIGTERM, and KillGrace later SIGKILL.
+	 */
+	TimeLimit, KillGrace time.Duration
+	/* Resource limits for the program on each node, by name: as, cpu, ... */
+	Rlimits map[string]uint64
+	/* Limits for the cgroup each node puts the program in, if not zero:
+	 * memory in bytes, CPUs (1.5 is one and a half), number of processes.
+	 */
+	MemoryMax int64
+	Cpus      float64
+	PidsMax   int
 	/* The File element should really replace Cmds */
 	Files []*filemarshal.File
 }
 
+/* An mpmdGroup is one of the <nodes> <command> groups of an MPMD job, with the files its nodes need. */
+type mpmdGroup struct {
+	Nodes           string
+	Args            []string
+	Cmds            []*cmdToExec
+	BytesToTransfer int64
+}
+
+/*
+ * split returns the requests that go out to the nodes for the job: one
+ * for each group of an MPMD job, each with that group's nodes, program
+ * and files, and the rest of the job as it is; otherwise just the one.
+ */
+func (s *StartReq) split() []*StartReq {
+	if len(s.Mpmd) == 0 {
+		return []*StartReq{s}
+	}
+	l := []*StartReq{}
+	for _, g := range s.Mpmd {
+		r := *s
+		r.Mpmd = nil
+		r.Nodes, r.Args, r.Cmds, r.BytesToTransfer = g.Nodes, g.Args, g.Cmds, g.BytesToTransfer
+		l = append(l, &r)
+	}
+	return l
+}
+
+/* wantsCgroup says whether the request has limits only a cgroup can enforce. */
+func (s *StartReq) wantsCgroup() bool {
+	return s.MemoryMax > 0 || s.Cpus > 0 || s.PidsMax > 0
+}
+
 func (s *StartReq) String() string {
 	return fmt.Sprint(s.Nodes, " ", s.Peers, " ", s.Args, " ", s.Cmds)
 }
@@ -133,11 +238,15 @@ type Worker struct {
 }
 
 type SlaveInfo struct {
-	Id     string
-	Addr   string
-	Server string
-	Nodes  []string
-	Rpc    *RpcClientServer
+	Id       string
+	Addr     string
+	Server   string
+	Hostname string
+	Labels   map[string]string
+	Nodes    []string
+	Children []nodeInfo
+	Key      string
+	Rpc      *RpcClientServer
 }
 
 func (s *SlaveInfo) String() string {
@@ -215,8 +324,9 @@ func RecvPrint(funcname, from interface{}, arg interface{}) {
 var roleFunc func(role string)
 
 type RpcClientServer struct {
-	E filemarshal.Encoder
-	D filemarshal.Decoder
+	E        filemarshal.Encoder
+	D        filemarshal.Decoder
+	sendLock sync.Mutex // several goroutines may Send on one connection
 }
 
 // This is the best way I've come up with to let the slave specify where
@@ -232,12 +342,15 @@ func NewRpcClientServer(rw io.ReadWriter, root string) *RpcClientServer {
 
 var onSendFunc func(funcname string, w io.Writer, arg interface{})
 
-func (r *RpcClientServer) Send(funcname string, arg interface{}) {
+func (r *RpcClientServer) Send(funcname string, arg interface{}) (err error) {
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
 	SendPrint(funcname, r, arg)
-	err := r.E.Encode(arg)
+	err = r.E.Encode(arg)
 	if err != nil {
 		log_info(funcname, ": Send: ", err)
 	}
+	return
 }
 
 var onRecvFunc func(funcname string, r io.Reader, arg interface{})
@@ -296,6 +409,10 @@ func Listen(fam, laddr string) (l Listener, err error) {
 	return
 }
 
+func (l Listener) Close() error {
+	return l.l.Close()
+}
+
 var onAcceptFunc func(c net.Conn)
 
 func (l Listener) Accept() (c net.Conn, err error) {
@@ -328,7 +445,7 @@ func WaitAllChildren() {
  * This function builds up a list of files that need to go out to the current node's sub-nodes.
  * It is called by both the master and, if a more complex hierarchy is used, the upper-level slaves.
  */
-func cacheRelayFilesAndDelegateExec(arg *StartReq, root, clientnode string) error {
+func cacheRelayFilesAndDelegateExec(arg *StartReq, root string, clientnode server, sent func(err error)) error {
 	log_info("cacheRelayFilesAndDelegateExec: files ", arg.Cmds, " nodes: ", clientnode, " fileServer: ", arg.Lfam, arg.Lserver)
 
 	larg := newStartReq(arg)
@@ -346,9 +463,15 @@ func cacheRelayFilesAndDelegateExec(arg *StartReq, root, clientnode string) erro
 		larg.Files = append(larg.Files, f)
 	}
 
-	client, err := Dial(*defaultFam, "", clientnode)
+	client, err := Dial(*defaultFam, "", clientnode.Addr)
 	if err != nil {
-		log_info("cacheRelayFilesAndDelegateExec: dialing: ", clientnode, ": ", err)
+		log_info("cacheRelayFilesAndDelegateExec: dialing: ", clientnode.Addr, ": ", err)
+		return err
+	}
+	/* the node takes nothing from us until we show we are its parent */
+	if _, err = io.WriteString(client, clientnode.Key); err != nil {
+		log_info("cacheRelayFilesAndDelegateExec: ", clientnode.Addr, ": ", err)
+		client.Close()
 		return err
 	}
 	log_info("connected to %v\n", client)
@@ -358,7 +481,7 @@ func cacheRelayFilesAndDelegateExec(arg *StartReq, root, clientnode string) erro
 		// This Send pushes our larg struct to filemarshal. Since it contains a
 		// []*filemarshal.File, the filemarshal grabs the list of files and sends
 		// the file contents too.
-		rpc.Send("cacheRelayFilesAndDelegateExec", larg)
+		err := rpc.Send("cacheRelayFilesAndDelegateExec", larg)
 		log_info("bytesToTransfer %v localbin %v\n", arg.BytesToTransfer, arg.LocalBin)
 
 		if arg.LocalBin {
@@ -366,24 +489,311 @@ func cacheRelayFilesAndDelegateExec(arg *StartReq, root, clientnode string) erro
 		}
 		log_info("cacheRelayFilesAndDelegateExec DONE")
 		/* at this point it is out of our hands */
+		sent(err)
 	}()
 
 	return nil
 }
 
+/* An ioMsg is what travels over an ioProxy connection. Going up, towards
+ * the master and on to the gproc that issued the exec, it is a chunk of a
+ * node's stdout or stderr, or news that the node's program has started or
+ * finished, all tagged with the full id of the node. Going down it is
+ * stdin or a signal for the programs.
+ */
+type ioMsg struct {
+	Kind   int
+	Id     string
+	Data   []byte
+	Status *exitStatus
+	Sig    int
+	To     []string /* going down: the full ids of the nodes it is for, if not all of them */
+	/* going down: the new size of the terminal, for a -tty job */
+	Rows, Cols int
+}
+
+const (
+	ioStdout = iota
+	ioStderr
+	ioStarted
+	ioExit
+	ioDone /* from the master: every node has finished */
+	ioStdin
+	ioStdinEOF
+	ioSignal
+	ioFailFast /* from the master: node Id failed, so the -fail-fast job is being torn down */
+	ioReady    /* a staged job has its files on node Id and every node below it */
+	ioGo       /* from the master: every node of a staged job is ready, start the program */
+	ioWinsize  /* the user's terminal has changed size */
+	ioStaged   /* a staged job has reached node Id, which waits for the go before it starts */
+)
+
+/* An exitStatus says how a node's program finished. */
+type exitStatus struct {
+	Code     int    // exit code, if it exited
+	Signal   int    // the signal that killed it, if one did
+	Lost     bool   // the node went away without telling us
+	Err      string // the program could not be run at all
+	TimedOut bool   // it was killed for running past the job's time limit
+	Limit    string // the limit it was killed for exceeding, if any
+	/* what the program and everything it started used, if it ran in a cgroup */
+	MemPeak int64
+	CPUTime time.Duration
+	/* when the program started and finished, by the node's clock */
+	Start, End time.Time
+}
+
+func newExitStatus(w *os.ProcessState) *exitStatus {
+	ws := w.Sys().(syscall.WaitStatus)
+	if ws.Signaled() {
+		return &exitStatus{Signal: int(ws.Signal())}
+	}
+	return &exitStatus{Code: ws.ExitStatus()}
+}
+
+func (e *exitStatus) Failed() bool {
+	return e.Code != 0 || e.Signal != 0 || e.Lost || e.Err != "" || e.TimedOut || e.Limit != ""
+}
+
+/* ExitCode is what a shell would make of the status; 124 means timed out, as for timeout(1). */
+func (e *exitStatus) ExitCode() int {
+	switch {
+	case e.TimedOut:
+		return 124
+	case e.Signal != 0:
+		return 128 + e.Signal
+	case e.Lost, e.Err != "":
+		return 1
+	}
+	return e.Code
+}
+
+func (e *exitStatus) String() string {
+	switch {
+	case e.Err != "":
+		return e.Err
+	case e.Lost:
+		return "lost"
+	case e.Limit != "" && e.Signal != 0:
+		return fmt.Sprint("exceeded its ", e.Limit, " limit, killed by signal ", e.Signal)
+	case e.Limit != "":
+		return fmt.Sprint("exceeded its ", e.Limit, " limit, exit ", e.Code)
+	case e.TimedOut && e.Signal != 0:
+		return fmt.Sprint("timed out, killed by signal ", e.Signal)
+	case e.TimedOut:
+		return fmt.Sprint("timed out, exit ", e.Code)
+	case e.Signal != 0:
+		return fmt.Sprint("killed by signal ", e.Signal)
+	}
+	return fmt.Sprint("exit ", e.Code)
+}
+
+/* Usage describes what the node used, if it knows. */
+func (e *exitStatus) Usage() string {
+	u := []string{}
+	if e.MemPeak != 0 {
+		u = append(u, "peak memory "+formatSize(e.MemPeak))
+	}
+	if e.CPUTime != 0 {
+		u = append(u, fmt.Sprint("cpu ", e.CPUTime))
+	}
+	if len(u) == 0 {
+		return "-"
+	}
+	return strings.Join(u, ", ")
+}
+
+/* formatSize prints a number of bytes the way parseSize reads them. */
+func formatSize(n int64) string {
+	for _, u := range []string{"", "K", "M", "G"} {
+		if n < 10<<10 {
+			return fmt.Sprint(n, u)
+		}
+		n >>= 10
+	}
+	return fmt.Sprint(n, "T")
+}
+
+/* fullId returns the id of a node whose parent has id parentId. */
+func fullId(parentId, id string) string {
+	if parentId == "" {
+		return id
+	}
+	return parentId + "/" + id
+}
+
+/*
+ * A downstream is the set of connections an ioProxy has accepted from
+ * the nodes below it. Anything headed for the leaves is copied to every
+ * one of them. Sub-nodes connect whenever they get around to it, so Send
+ * holds on to the message until all the nodes we Expect have shown up;
+ * otherwise the slow ones would miss the start of their stdin. A node
+ * that has not shown up -connectwait after its files reached it, or that
+ * they could not be sent to, is given up for lost, and turned away if it
+ * connects after all.
+ */
+type downstream struct {
+	sync.Mutex
+	cond   *sync.Cond
+	conns  []*RpcClientServer
+	here   map[string]bool /* the nodes that have connected */
+	expect map[string]bool /* the nodes yet to connect; nil until Expect */
+	gaveUp map[string]bool
+	lost   func(id string) /* called for each node given up */
+}
+
+func newDownstream(lost func(id string)) *downstream {
+	d := &downstream{here: make(map[string]bool), gaveUp: make(map[string]bool), lost: lost}
+	d.cond = sync.NewCond(&d.Mutex)
+	return d
+}
+
+/*
+ * arrived adds the connection from node 'id', which it names in its
+ * first ioMsg, and says whether it is still wanted.
+ */
+func (d *downstream) arrived(id string, r *RpcClientServer) bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.gaveUp[id] {
+		return false
+	}
+	d.here[id] = true
+	delete(d.expect, id)
+	d.conns = append(d.conns, r)
+	d.cond.Broadcast()
+	return true
+}
+
+/* Expect tells the downstream which nodes will connect. Until it is
+ * called, Send waits.
+ */
+func (d *downstream) Expect(ids []string) {
+	d.Lock()
+	defer d.Unlock()
+	d.expect = make(map[string]bool)
+	for _, id := range ids {
+		if !d.here[id] && !d.gaveUp[id] {
+			d.expect[id] = true
+		}
+	}
+	d.cond.Broadcast()
+}
+
+/*
+ * Sent says the job has gone to node 'id', files and all, or that it
+ * could not be sent there, in which case err says why. Only then does
+ * the node's -connectwait start: it cannot connect before it has its
+ * files, however long they take.
+ */
+func (d *downstream) Sent(id string, err error) {
+	if err != nil {
+		log_info("downstream: sending to node ", id, ": ", err)
+		d.giveUp(id)
+		return
+	}
+	time.AfterFunc(*connectWait, func() { d.giveUp(id) })
+}
+
+/* giveUp gives up on node 'id', unless it has connected. */
+func (d *downstream) giveUp(id string) {
+	d.Lock()
+	if d.here[id] || d.gaveUp[id] {
+		d.Unlock()
+		return
+	}
+	d.gaveUp[id] = true
+	delete(d.expect, id)
+	d.cond.Broadcast()
+	d.Unlock()
+	log_info("downstream: giving up on node ", id)
+	d.lost(id)
+}
+
+func (d *downstream) Send(m *ioMsg) {
+	d.Lock()
+	defer d.Unlock()
+	for d.expect == nil || len(d.expect) > 0 {
+		d.cond.Wait()
+	}
+	for _, r := range d.conns {
+		r.Send("downstream", m)
+	}
+}
+
+/*
+ * A stage keeps track, for a staged job, of the nodes we have sent it to
+ * that have yet to say they are ready. Each speaks for the whole of its
+ * subtree. A node that exits instead, lost or unable to run the program,
+ * is as ready as it will ever be; so is one that never connects to our
+ * ioProxy, which reports it lost after -connectwait.
+ */
+type stage struct {
+	sync.Mutex
+	cond    *sync.Cond
+	waiting map[string]bool
+	ready   map[string]bool
+}
+
+func newStage() *stage {
+	s := &stage{waiting: make(map[string]bool), ready: make(map[string]bool)}
+	s.cond = sync.NewCond(&s.Mutex)
+	return s
+}
+
+/* Expect says we have sent the job to node 'id'. It may have said it is ready already. */
+func (s *stage) Expect(id string) {
+	s.Lock()
+	defer s.Unlock()
+	if !s.ready[id] {
+		s.waiting[id] = true
+	}
+}
+
+/* Update takes note of the ioMsgs coming up, and says whether m was an ioReady. */
+func (s *stage) Update(m *ioMsg) bool {
+	if m.Kind != ioReady && m.Kind != ioExit {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.ready[m.Id] = true
+	delete(s.waiting, m.Id)
+	s.cond.Broadcast()
+	return m.Kind == ioReady
+}
+
+/* Wait waits until all the nodes we Expect are ready. */
+func (s *stage) Wait() {
+	s.Lock()
+	defer s.Unlock()
+	for len(s.waiting) > 0 {
+		s.cond.Wait()
+	}
+}
+
 /*
  * The ioProxy listens for incoming connections. Sub-nodes will connect to it
- * and use the connection as stdin, stdout, and stderr for the programs they
- * execute. ioProxy copies the output of the connection to 'dest', which will
- * be a connection to another ioProxy if we're on a slave or simply stdout
- * if we're in the gproc issuing the exec command.
+ * and send the output of the programs they execute over the connection
+ * as ioMsgs. ioProxy hands each ioMsg to 'dest', which will send it on
+ * to another ioProxy if we're on a slave or print it if we're in the gproc
+ * issuing the exec command. Going the other way, the returned downstream
+ * is used to send stdin and signals down to the sub-nodes.
  * 
  * Whoever calls the ioProxy should read from workerChan to know when I/O is 
  * finished. workerChan will contain one int for every client which has 
- * completed and disconnected.
+ * completed and disconnected. If a connection goes away while a node
+ * behind it has started but not finished, ioProxy sends on an ioExit
+ * saying the node was lost, so nobody waits for it forever. The same
+ * goes for a node that never connects at all, which also counts as a
+ * client that has finished.
  */
-func ioProxy(fam, server string, dest io.Writer) (workerChan chan int, l Listener, err error) {
+func ioProxy(fam, server string, dest func(m *ioMsg)) (workerChan chan int, l Listener, down *downstream, err error) {
 	workerChan = make(chan int, 0)
+	down = newDownstream(func(id string) {
+		dest(&ioMsg{Kind: ioExit, Id: id, Status: &exitStatus{Lost: true}})
+		workerChan <- 0
+	})
 	l, err = Listen(fam, server)
 	if err != nil {
 		log_error("ioproxy: Listen: %v\n", err)
@@ -392,125 +802,253 @@ func ioProxy(fam, server string, dest io.Writer) (workerChan chan int, l Listene
 	go func() {
 		for whichWorker := 7090; ; whichWorker++ {
 			conn, err := l.Accept()
-			log_info("ioProxy: connected by ", conn.RemoteAddr())
-
 			if err != nil {
 				log_info("ioProxy: accept:", err)
-				continue
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
 			}
-			go func(id int, conn net.Conn) {
+			log_info("ioProxy: connected by ", conn.RemoteAddr())
+
+			r := NewRpcClientServer(conn, *binRoot)
+			go func(id int, conn net.Conn, r *RpcClientServer) {
 				log_info("ioProxy: start reading ", id)
-				n, err := io.Copy(dest, conn)
-				workerChan <- id
-				log_info("ioProxy: read ", n)
-				if err != nil {
-					log_error("ioProxy: ", err)
+				running := make(map[string]bool)
+				/* a node says who it is first thing */
+				first := &ioMsg{}
+				if r.Recv("ioProxy", first) != nil || !down.arrived(first.Id, r) {
+					log_info("ioProxy: dropping connection ", id, " from node ", first.Id)
+					conn.Close()
+					return
+				}
+				for m := first; ; {
+					switch m.Kind {
+					case ioStarted, ioStaged:
+						running[m.Id] = true
+					case ioExit:
+						delete(running, m.Id)
+					}
+					dest(m)
+					m = &ioMsg{}
+					if r.Recv("ioProxy", m) != nil {
+						break
+					}
+				}
+				for n := range running {
+					dest(&ioMsg{Kind: ioExit, Id: n, Status: &exitStatus{Lost: true}})
 				}
+				workerChan <- id
 				log_info("ioProxy: end")
-			}(whichWorker, conn)
+			}(whichWorker, conn, r)
 		}
 	}()
 	return
 }
 
-type nodeExecList struct {
-	Nodes    []string
-	Subnodes string
+/* A delegation is a sub-node to send a job to, and the node list it is to pass on. */
+type delegation struct {
+	Id, Subnodes string
+	Server       server
 }
 
-/* might be fun to do this as a goroutine feeding a chan of nodeExecList */
-/* precedence: comma lowest, then /, then -. I hope. 
- * this makes semi-sensible stuff work. 
- * 1-3/1-3 is all of nodes 1-3 on nodes 1-3. If you want, say, node 1, 2, 
- * and 3/1-3, then write it as 1-2,3/1-3. This form is oriented to what we
- * learned in practice with bproc and xcpu. BTW one thing we learned
- * the really hard way: few people understand regular expressions. So we
- * don't use them. 
+/*
+ * delegate works out which of our sub-nodes a node list names, given
+ * their ids and servers, and the node list each of them is to pass on.
+ * A node named more than once gets the job once, with all its lists:
+ * 1/3,1/4 sends node 1 the list 3,4.
  */
-func parseNodeList(l string) (rl []nodeExecList, err error) {
-	/* bust it apart by , */
-	ranges := strings.SplitN(l, ",", -1)
-	for _, n := range ranges {
-		/* split into range and rest by the slash */
-		l := strings.SplitN(n, "/", 2)
-		be := strings.SplitN(l[0], "-", 2)
-		log_info(" l is ", l, " be is ", be)
-		ne := &nodeExecList{Nodes: make([]string, 1)}
-		if len(l) > 1 {
-			ne.Subnodes = l[1]
+func delegate(spec string, servers map[string]server) ([]delegation, error) {
+	s, err := nodespec.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	ids := nodeIds{}
+	for id := range servers {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	d := []delegation{}
+	for _, id := range ids {
+		if runs, sub := s.Child(id); runs {
+			d = append(d, delegation{Id: id, Server: servers[id], Subnodes: sub.String()})
 		}
-		if len(be) == 1 {
-			ne.Nodes[0] = be[0]
-		} else {
-			/* BOGUS! check for bad range here. */
-			beg, _ := strconv.Atoi(be[0])
-			end, _ := strconv.Atoi(be[1])
-			if end < beg {
-				goto BadRange
-			}
-			for i := beg; i <= end; i++ {
-				ne.Nodes = append(ne.Nodes, fmt.Sprintf("%d", i))
-			}
+	}
+	return d, nil
+}
+
+/*
+ * expandNodes adds to 'into' the full id and address of every node a
+ * node list names, starting from 'nodes', the sub-nodes of the node
+ * with full id 'parent'. Every node along the way is named too, since
+ * it runs the job as well: 1/3 names 1 and 1/3.
+ */
+func expandNodes(spec nodespec.Spec, parent string, nodes []nodeInfo, into map[string]string) {
+	for _, n := range nodes {
+		runs, sub := spec.Child(n.Id)
+		if !runs {
+			continue
 		}
-		rl = append(rl, *ne)
+		fid := fullId(parent, n.Id)
+		into[fid] = strings.SplitN(n.Addr, ":", 2)[0]
+		expandNodes(sub, fid, n.Children, into)
 	}
+}
 
-	log_info("parseNodeList returns ", rl)
-	return
-BadRange:
-	err = BadRangeErr
+/*
+ * rankNodes expands a node list against the registry, for a job: the
+ * ranks are the nodes' places in node id order, and the addresses go
+ * with them.
+ */
+func rankNodes(spec string) (ranks, addrs []string, err error) {
+	s, err := nodespec.Parse(spec)
+	if err != nil {
+		return
+	}
+	m := make(map[string]string)
+	expandNodes(s, "", slaves.Tree(), m)
+	ids := nodeIds{}
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	for _, id := range ids {
+		ranks = append(ranks, id)
+		addrs = append(addrs, m[id])
+	}
 	return
 }
 
-func doPrivateMount(pathbase string) {
-	unshare()
-	_ = syscall.Unmount(*binRoot, 0)
-	syscallerr := privatemount(*binRoot)
-	if syscallerr != 0 {
-		log_error("Mount failed ", syscallerr)
+/* nodeTable adds to 'into' the nodeInfo of every node in the tree, by full id. */
+func nodeTable(parent string, nodes []nodeInfo, into map[string]nodeInfo) {
+	for _, n := range nodes {
+		fid := fullId(parent, n.Id)
+		into[fid] = n
+		nodeTable(fid, n.Children, into)
 	}
 }
 
 /*
- * Make a TCP connection to a server, return both the connection and
- * a File pointing to that connection.
+ * specTree is the tree of nodes under 'nodes', the sub-nodes of the node
+ * with full id 'parent', as nodespec.Resolve wants it. The nodes in
+ * 'busy' are marked busy.
  */
-func fileTcpDial(server string) (*os.File, net.Conn, error) {
-	var laddr net.TCPAddr
-	raddr, err := net.ResolveTCPAddr("tcp4", server)
-	if err != nil {
-		return nil, nil, err
+func specTree(parent string, nodes []nodeInfo, busy map[string]bool) []nodespec.Node {
+	t := []nodespec.Node{}
+	for _, n := range nodes {
+		fid := fullId(parent, n.Id)
+		t = append(t, nodespec.Node{Id: n.Id, Host: n.Hostname, Labels: n.Labels, Busy: busy[fid], Children: specTree(fid, n.Children, busy)})
 	}
-	c, err := net.DialTCP(*defaultFam, &laddr, raddr)
+	return t
+}
+
+/*
+ * resolveNodes turns the host names, labels and groups in a node list
+ * into the ids of the nodes they name, by the registry, so that the
+ * nodes below, which only know their own sub-nodes, need only deal in
+ * ids. It is for node lists that name nodes, as "gproc kill" and "gproc i"
+ * take; counts, which pick nodes for a job to run on, are refused. For
+ * those, see resolveJobNodes.
+ */
+func resolveNodes(spec string) (string, error) {
+	s, err := nodespec.Parse(spec)
 	if err != nil {
-		return nil, nil, err
+		return "", err
+	}
+	for _, t := range s {
+		if t.Count > 0 {
+			return "", errors.New(t.String() + ": a count only picks nodes for a job to run on")
+		}
 	}
-	f, err := c.File()
+	return resolveSpec(s, nil)
+}
+
+/* resolveSpec resolves a parsed node list, counts picking only nodes that are not in 'busy'. */
+func resolveSpec(s nodespec.Spec, busy map[string]bool) (string, error) {
+	s, err := s.Resolve(specTree("", slaves.Tree(), busy), nodeGroups.Specs())
 	if err != nil {
-		c.Close()
-		return nil, nil, err
+		return "", err
 	}
+	return s.String(), nil
+}
 
-	return f, c, nil
+/*
+ * resolveJobNodes resolves the node list of a job, or of each of its
+ * groups in turn, counts picking only nodes that no other job, nor an
+ * earlier group, is using. For the nodes it picks to stay the job's, it
+ * must be called under jobs.Allocate.
+ */
+func resolveJobNodes(a *StartReq) (err error) {
+	busy := jobs.Busy()
+	resolve := func(spec string) (string, error) {
+		s, err := nodespec.Parse(spec)
+		if err != nil {
+			return "", err
+		}
+		return resolveSpec(s, busy)
+	}
+	if len(a.Mpmd) == 0 {
+		a.Nodes, err = resolve(a.Nodes)
+		return
+	}
+	specs := []string{}
+	for i := range a.Mpmd {
+		g := &a.Mpmd[i]
+		if g.Nodes, err = resolve(g.Nodes); err != nil {
+			return
+		}
+		ids, _, err := rankNodes(g.Nodes)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			busy[id] = true
+		}
+		specs = append(specs, g.Nodes)
+	}
+	a.Nodes = strings.Join(specs, ",")
+	return
 }
 
-func newStartReq(arg *StartReq) *StartReq {
-	return &StartReq{
-		Command:         arg.Command,
-		Nodes:           arg.Nodes,
-		ThisNode:        true,
-		LocalBin:        arg.LocalBin,
-		Peers:           arg.Peers,
-		Args:            arg.Args,
-		Env:             arg.Env,
-		LibList:         arg.LibList,
-		Path:            arg.Path,
-		Lfam:            arg.Lfam,
-		Lserver:         arg.Lserver,
-		Cmds:            arg.Cmds,
-		BytesToTransfer: arg.BytesToTransfer,
-		Cwd:             arg.Cwd,
+/*
+ * jobRanks ranks the nodes of a job. The groups of an MPMD job are ranked
+ * in turn, group 1's nodes first, and may not share a node, which could
+ * only run one of their programs.
+ */
+func jobRanks(a *StartReq) (ranks, addrs []string, err error) {
+	group := make(map[string]int)
+	for i, g := range a.split() {
+		r, ad, err := rankNodes(g.Nodes)
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, id := range r {
+			if k, ok := group[id]; ok {
+				return nil, nil, errors.New(fmt.Sprint("node ", id, " is in groups ", k+1, " and ", i+1))
+			}
+			group[id] = i
+			ranks = append(ranks, id)
+			addrs = append(addrs, ad[j])
+		}
 	}
+	return
+}
+
+func doPrivateMount(pathbase string) {
+	unshare()
+	_ = syscall.Unmount(*binRoot, 0)
+	syscallerr := privatemount(*binRoot)
+	if syscallerr != 0 {
+		log_error("Mount failed ", syscallerr)
+	}
+}
+
+func newStartReq(arg *StartReq) *StartReq {
+	/* everything the nodes need to run the job goes along; the files are added as we go */
+	larg := *arg
+	larg.ThisNode = true
+	larg.Files = nil
+	return &larg
 }
 
 /*
@@ -526,7 +1064,6 @@ func registerSlaves() error {
 	log_info("-cmdport=", l.Addr())
 	log_info(l.Addr())
 
-	slaves = newSlaves()
 	for {
 		vd := &vitalData{}
 		c, err := l.Accept()
@@ -556,48 +1093,103 @@ func registerSlaves() error {
 			vd.ServerAddr = strings.SplitN(c.RemoteAddr().String(), ":", 2)[0] + vd.ServerAddr[7:]
 			log_info("Guessed remote slave ServerAddr is ", vd.ServerAddr)
 		}
-		resp := slaves.Add(vd, r)
+		s, resp := slaves.Add(vd, r)
 		r.Send("registerSlaves", resp)
+		go watchSlave(r, s)
 	}
 	log_info("registerSlaves is exiting! That can't be good!")
 	return nil
 }
 
+/*
+ * watchSlave takes a slave's news of its own sub-nodes until it goes
+ * away, when it is taken out of the registry.
+ */
+func watchSlave(r *RpcClientServer, s *SlaveInfo) {
+	for {
+		var n nodeInfo
+		if r.Recv("watchSlave", &n) != nil {
+			break
+		}
+		slaves.SetChildren(s, n.Children)
+	}
+	slaves.Remove(s)
+}
+
+/* reportSlaves tells our parent about our sub-nodes whenever they change. */
+func reportSlaves(r *RpcClientServer) {
+	for _ = range slaves.changed {
+		r.Send("reportSlaves", nodeInfo{Id: id, Children: slaves.Tree()})
+	}
+}
+
+/*
+ * Slaves is the registry of the nodes that have registered with us. The
+ * master's and each slave's are changed as nodes come and go, and read
+ * by every request, so they are locked.
+ */
 type Slaves struct {
+	sync.Mutex
 	Slaves  map[string]*SlaveInfo
 	Addr2id map[string]string
+	changed chan bool
 }
 
-func newSlaves() (s Slaves) {
-	s.Slaves = make(map[string]*SlaveInfo)
-	s.Addr2id = make(map[string]string)
-	return
+func newSlaves() *Slaves {
+	return &Slaves{Slaves: make(map[string]*SlaveInfo), Addr2id: make(map[string]string), changed: make(chan bool, 1)}
 }
 
-func (sv *Slaves) Add(vd *vitalData, r *RpcClientServer) (resp SlaveResp) {
-	var s *SlaveInfo
+/* change notes that the registry has changed, for reportSlaves. */
+func (sv *Slaves) change() {
+	select {
+	case sv.changed <- true:
+	default:
+	}
+}
+
+func (sv *Slaves) Add(vd *vitalData, r *RpcClientServer) (s *SlaveInfo, resp SlaveResp) {
 	s = &SlaveInfo{
-		Id:     vd.Id,
-		Addr:   vd.HostAddr,
-		Server: vd.ServerAddr,
-		Nodes:  vd.Nodes,
-		Rpc:    r,
+		Id:       vd.Id,
+		Addr:     vd.HostAddr,
+		Server:   vd.ServerAddr,
+		Hostname: vd.Hostname,
+		Labels:   vd.Labels,
+		Nodes:    vd.Nodes,
+		Key:      vd.Key,
+		Rpc:      r,
 	}
+	sv.Lock()
 	sv.Slaves[s.Id] = s
 	sv.Addr2id[s.Server] = s.Id
+	sv.Unlock()
+	sv.change()
 	log_info("slave Add: Id: ", s.Id)
 	resp.Id = s.Id
 	return
 }
 
+/* Remove takes s out of the registry, unless it has been replaced already. */
 func (sv *Slaves) Remove(s *SlaveInfo) {
+	sv.Lock()
+	defer sv.Unlock()
+	if sv.Slaves[s.Id] != s {
+		return
+	}
 	log_info("Remove %v ", s, " slave %v", sv.Slaves[s.Id])
 	delete(sv.Slaves, s.Id)
 	delete(sv.Addr2id, s.Server)
+	sv.change()
 	log_info("slave Remove: Id: ", s)
 	return
 }
 
+func (sv *Slaves) SetChildren(s *SlaveInfo, children []nodeInfo) {
+	sv.Lock()
+	s.Children = children
+	sv.Unlock()
+	sv.change()
+}
+
 /* old school: functions with names like GetIP and GetID and so on. 
  * new school: overloading and picking via type signature
  * go school: well, strings are different. So let's try both styles. 
@@ -607,6 +1199,8 @@ func (sv *Slaves) Remove(s *SlaveInfo) {
  */
 func (sv *Slaves) Get(n string) (s *SlaveInfo, ok bool) {
 	log_info("Get: ", n)
+	sv.Lock()
+	defer sv.Unlock()
 	s, ok = sv.Slaves[n]
 	if !ok {
 		s, ok = sv.Slaves[sv.Addr2id[n]]
@@ -615,26 +1209,73 @@ func (sv *Slaves) Get(n string) (s *SlaveInfo, ok bool) {
 	return
 }
 
-/* a hack for now. Sorry, we need to clean up the whole parsenodelist/intersect thing
- * but I need something that works and we're still putting the ideas 
- * together. So sue me. 
+/* A server is where a sub-node takes jobs, and the key it wants from whoever sends one. */
+type server struct {
+	Addr, Key string
+}
+
+/* String leaves the key out of the logs. */
+func (s server) String() string {
+	return s.Addr
+}
+
+/* Servers maps the id of each of our sub-nodes to its server. */
+func (sv *Slaves) Servers() map[string]server {
+	sv.Lock()
+	defer sv.Unlock()
+	m := make(map[string]server, len(sv.Slaves))
+	for id, s := range sv.Slaves {
+		m[id] = server{Addr: s.Server, Key: s.Key}
+	}
+	return m
+}
+
+/*
+ * newKey makes the key a slave gives its parent when it registers. The
+ * slave runs jobs as whoever they say, so it takes them only from a
+ * connection that starts with the key; anyone else who finds its port
+ * gets nowhere.
  */
-func (sv *Slaves) ServIntersect(set []string) (i []string) {
-	switch set[0] {
-	case ".":
-		for _, n := range sv.Slaves {
-			i = append(i, n.Server)
-		}
-	default:
-		for _, n := range set {
-			s, ok := sv.Get(n)
-			if !ok {
-				continue
-			}
-			i = append(i, s.Server)
-		}
+func newKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log_error("newKey: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+/* checkKey reads a key from c, giving up after 'wait', and says whether it is 'key'. */
+func checkKey(c net.Conn, key string, wait time.Duration) bool {
+	b := make([]byte, len(key))
+	c.SetReadDeadline(time.Now().Add(wait))
+	defer c.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(c, b); err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(b, []byte(key)) == 1
+}
+
+/* List returns copies of the registry's entries, in node id order. */
+func (sv *Slaves) List() (l []SlaveInfo) {
+	sv.Lock()
+	defer sv.Unlock()
+	ids := nodeIds{}
+	for id := range sv.Slaves {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	for _, id := range ids {
+		l = append(l, *sv.Slaves[id])
+	}
+	return
+}
+
+/* Tree returns the nodeInfo of each of our sub-nodes, in node id order. */
+func (sv *Slaves) Tree() (t []nodeInfo) {
+	for _, s := range sv.List() {
+		t = append(t, nodeInfo{Id: s.Id, Addr: s.Addr, Hostname: s.Hostname, Labels: s.Labels, Children: s.Children})
 	}
 	return
 }
 
-var slaves Slaves
+var slaves = newSlaves()
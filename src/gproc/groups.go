@@ -0,0 +1,213 @@
+/*
+ * gproc, a Go reimplementation of the LANL version of bproc and the LANL XCPU software.
+ *
+ * This software is released under the GNU Lesser General Public License, version 2, incorporated herein by reference.
+ *
+ * Copyright (2010) Sandia Corporation. Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+ * the U.S. Government retains certain rights in this software.
+ */
+
+/*
+ * Named node groups. The master's -groups file gives names to node
+ * lists, one to a line, "rack1 = 1-7/1-6", and anywhere a node list is
+ * wanted %rack1 then stands for those nodes. The master reads the file
+ * when it starts, and again on SIGHUP; "gproc groups" lists the groups
+ * and the nodes in them as things stand.
+ */
+
+package main
+
+import (
+	"bitbucket.org/floren/gproc/src/nodespec"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+type groupTable struct {
+	sync.Mutex
+	names []string /* in the order of the file */
+	defs  map[string]string
+	specs map[string]nodespec.Spec
+}
+
+var nodeGroups = &groupTable{defs: make(map[string]string), specs: make(map[string]nodespec.Spec)}
+
+/*
+ * Load reads a groups file. Blank lines and lines starting with # are
+ * skipped. If anything in it is wrong -- a bad node list, a count, a
+ * group that is not there, or one that takes in itself -- the groups
+ * stay as they were.
+ */
+func (g *groupTable) Load(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	defs := make(map[string]string)
+	specs := make(map[string]nodespec.Spec)
+	for i, l := range strings.Split(string(b), "\n") {
+		if l = strings.TrimSpace(l); l == "" || l[0] == '#' {
+			continue
+		}
+		where := fmt.Sprint(file, ":", i+1, ": ")
+		kv := strings.SplitN(l, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !labelWord(name) {
+			return errors.New(where + "want name = nodes")
+		}
+		if _, ok := defs[name]; ok {
+			return errors.New(where + "group " + name + " again")
+		}
+		defs[name] = strings.TrimSpace(kv[1])
+		if specs[name], err = nodespec.Parse(defs[name]); err != nil {
+			return errors.New(where + err.Error())
+		}
+		for _, t := range specs[name] {
+			if t.Count > 0 {
+				/* a count picks idle nodes for a job as it starts; a group is the same nodes every time */
+				return errors.New(fmt.Sprint(where, "group ", name, ": #", t.Count, " picks nodes for a job, not a group"))
+			}
+		}
+		names = append(names, name)
+	}
+	/* with no nodes, this only checks that the groups are all there */
+	for _, name := range names {
+		if _, err := specs[name].Resolve(nil, specs); err != nil {
+			return errors.New(file + ": " + err.Error())
+		}
+	}
+	g.Lock()
+	defer g.Unlock()
+	g.names, g.defs, g.specs = names, defs, specs
+	return nil
+}
+
+/* Specs returns the groups' node lists, by name, as nodespec.Resolve wants them. */
+func (g *groupTable) Specs() map[string]nodespec.Spec {
+	g.Lock()
+	defer g.Unlock()
+	m := make(map[string]nodespec.Spec, len(g.specs))
+	for name, s := range g.specs {
+		m[name] = s
+	}
+	return m
+}
+
+/* List returns the groups' names, in the order of the file, and their node lists as written. */
+func (g *groupTable) List() (names, defs []string) {
+	g.Lock()
+	defer g.Unlock()
+	for _, name := range g.names {
+		names = append(names, name)
+		defs = append(defs, g.defs[name])
+	}
+	return
+}
+
+/* reloadGroups reads the groups file again every time we get a SIGHUP. */
+func reloadGroups(file string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for _ = range sigs {
+		if err := nodeGroups.Load(file); err != nil {
+			log_info("reloading groups: ", err, "; keeping the old ones")
+			continue
+		}
+		log_info("reloaded groups from ", file)
+	}
+}
+
+/* groupList is the master's answer to "gproc groups". */
+type groupList struct {
+	Groups []groupInfo
+}
+
+/* groupInfo is one group: its node list as written, and the nodes in it now. */
+type groupInfo struct {
+	Name, Spec string
+	Ids, Hosts []string
+	Msg        string /* why the nodes could not be worked out */
+}
+
+/* listGroupsServer is the master's end of "gproc groups". */
+func listGroupsServer() (l groupList) {
+	names, defs := nodeGroups.List()
+	nodes := make(map[string]nodeInfo)
+	nodeTable("", slaves.Tree(), nodes)
+	for i, name := range names {
+		gi := groupInfo{Name: name, Spec: defs[i]}
+		spec, err := resolveNodes("%" + name)
+		if err == nil {
+			gi.Ids, _, err = rankNodes(spec)
+		}
+		if err != nil {
+			gi.Msg = err.Error()
+		}
+		for _, id := range gi.Ids {
+			gi.Hosts = append(gi.Hosts, nodes[id].Hostname)
+		}
+		l.Groups = append(l.Groups, gi)
+	}
+	return
+}
+
+/*
+ * listGroups is "gproc groups": it lists the master's groups, or the
+ * ones named, with the nodes in each as things stand -- every node that
+ * would run a job given the group, in node id order.
+ */
+func listGroups(masterAddr string, args []string) int {
+	log.SetPrefix("groups " + *prefix + ": ")
+	r := dialMaster(masterAddr)
+	r.Send("listGroups", StartReq{Command: "groups"})
+	var l groupList
+	if r.Recv("listGroups", &l) != nil {
+		log_error("groups failed")
+	}
+	want := make(map[string]bool)
+	for _, name := range args {
+		if strings.HasPrefix(name, "%") {
+			name = name[1:]
+		}
+		want[name] = true
+	}
+	rc := 0
+	found := make(map[string]bool)
+	for _, g := range l.Groups {
+		if len(want) > 0 && !want[g.Name] {
+			continue
+		}
+		found[g.Name] = true
+		fmt.Printf("%%%s = %s\n", g.Name, g.Spec)
+		switch {
+		case g.Msg != "":
+			fmt.Printf("\t%s\n", g.Msg)
+			rc = 1
+		case len(g.Ids) == 0:
+			fmt.Printf("\tno nodes\n")
+		default:
+			fmt.Printf("\t%d nodes: %s\n\thosts: %s\n", len(g.Ids), nodeRanges(g.Ids), nodespec.FormatHosts(g.Hosts))
+		}
+	}
+	missing := []string{}
+	for name := range want {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		fmt.Fprintln(os.Stderr, "gproc: no group", name)
+		rc = 1
+	}
+	return rc
+}
@@ -14,7 +14,7 @@ import (
 )
 
 func getInfo(masterAddr, query string) (info *Resp) {
-	req := StartReq{Command: "i"}
+	req := StartReq{Command: "i", Nodes: query}
 	log.SetPrefix("getIbfo " + *prefix + ": ")
 	client, err := Dial("unix", "", masterAddr)
 	if err != nil {
@@ -0,0 +1,594 @@
+/*
+ * gproc, a Go reimplementation of the LANL version of bproc and the LANL XCPU software.
+ *
+ * This software is released under the GNU Lesser General Public License, version 2, incorporated herein by reference.
+ *
+ * Copyright (2010) Sandia Corporation. Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+ * the U.S. Government retains certain rights in this software.
+ */
+
+/*
+ * Jobs. Every exec the master runs is a job, with an id the user can use
+ * to look at it ("gproc ps") and signal it ("gproc kill") from anywhere
+ * on the master node. A job started with "gproc e -d" is detached: the
+ * master keeps its output for "gproc attach", and keeps the job itself,
+ * once it has finished, until someone collects it with "gproc wait". The
+ * first half of this file is the master's job table; the second half is
+ * the client end of ps, kill, attach and wait.
+ */
+
+package main
+
+import (
+	"bitbucket.org/floren/gproc/src/nodespec"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+ * A Job is what the master knows about an exec it has started. Nodes
+ * are "sent" the job by the master (first level) or a slave, are
+ * "staged" while a staged job waits for the go, are "running" once
+ * their slave has started the program and are "done" once it has
+ * finished.
+ */
+type Job struct {
+	Id       int
+	Uid, Gid int
+	Args     []string
+	Nodes    string
+	Start    time.Time
+	State    map[string]*jobNode
+	Detached bool
+	Done     bool
+	FailedBy string /* the node whose failure tore down a -fail-fast job */
+	lock     *sync.Mutex
+	down     *downstream
+	done     chan bool
+	log      *jobLog
+	stage    *stage   /* for a staged job, until it has been told to go */
+	ranks    []string /* the nodes it was given */
+}
+
+type jobNode struct {
+	State  string
+	Status exitStatus
+}
+
+/*
+ * nodeStates puts the states of a node in order. News of a node can come
+ * in out of order -- one that cannot be sent the job may be lost before
+ * the master gets round to saying it was sent -- so a node never goes
+ * back to an earlier state.
+ */
+var nodeStates = map[string]int{"sent": 0, "staged": 1, "running": 2, "done": 3}
+
+func (j *Job) set(nodeId, state string, status *exitStatus) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	n, ok := j.State[nodeId]
+	if !ok {
+		n = &jobNode{}
+		j.State[nodeId] = n
+	}
+	if ok && nodeStates[state] < nodeStates[n.State] {
+		return
+	}
+	n.State = state
+	if status != nil {
+		n.Status = *status
+	}
+}
+
+/* sent records that the master has sent the job to one of its nodes. */
+func (j *Job) sent(nodeId string) {
+	j.set(nodeId, "sent", nil)
+	if j.stage != nil {
+		j.stage.Expect(nodeId)
+	}
+}
+
+/* update keeps track of the job's nodes as their ioMsgs go by. */
+func (j *Job) update(m *ioMsg) {
+	if j.stage != nil {
+		j.stage.Update(m)
+	}
+	switch m.Kind {
+	case ioStaged:
+		j.set(m.Id, "staged", nil)
+	case ioStarted:
+		j.set(m.Id, "running", nil)
+	case ioExit:
+		j.set(m.Id, "done", m.Status)
+	}
+}
+
+/*
+ * failed is told about each node of a -fail-fast job that fails. The
+ * first one tears the job down: every node still going gets SIGTERM,
+ * then SIGKILL if the job has not finished 'grace' later. failed says
+ * whether it was the first.
+ */
+func (j *Job) failed(nodeId string, grace time.Duration) bool {
+	j.lock.Lock()
+	first := j.FailedBy == ""
+	if first {
+		j.FailedBy = nodeId
+	}
+	j.lock.Unlock()
+	if !first {
+		return false
+	}
+	log_info("job ", j.Id, ": node ", nodeId, " failed, tearing the job down")
+	go func() {
+		j.Signal(syscall.SIGTERM, "")
+		select {
+		case <-j.done:
+		case <-time.After(grace):
+			j.Signal(syscall.SIGKILL, "")
+		}
+	}()
+	return true
+}
+
+/* finish marks the job done and wakes anyone waiting for it. */
+func (j *Job) finish() {
+	j.lock.Lock()
+	j.Done = true
+	j.lock.Unlock()
+	close(j.done)
+	if j.log != nil {
+		j.log.Close()
+	}
+}
+
+/* copy returns a copy of j that is safe to send while the job goes on changing. */
+func (j *Job) copy() Job {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	c := Job{Id: j.Id, Uid: j.Uid, Gid: j.Gid, Args: j.Args, Nodes: j.Nodes, Start: j.Start,
+		Detached: j.Detached, Done: j.Done, FailedBy: j.FailedBy}
+	c.State = make(map[string]*jobNode, len(j.State))
+	for n, s := range j.State {
+		ns := *s
+		c.State[n] = &ns
+	}
+	return c
+}
+
+/*
+ * Signal sends sig to the nodes of the job named by the node spec 'nodes',
+ * or to all of them if 'nodes' is empty, and returns how many that was.
+ * Unlike running a command, where 3/5 means node 3 and node 5 below it,
+ * the spec names exactly the nodes at the end of its paths: 3/5 names
+ * node 3/5 and not node 3.
+ */
+func (j *Job) Signal(sig syscall.Signal, nodes string) (n int, err error) {
+	m := &ioMsg{Kind: ioSignal, Sig: int(sig)}
+	spec, err := nodespec.Parse(nodes)
+	if err != nil {
+		return 0, err
+	}
+	c := j.copy()
+	for id, s := range c.State {
+		if s.State == "done" {
+			continue
+		}
+		if nodes != "" {
+			if !spec.Names(id) {
+				continue
+			}
+			m.To = append(m.To, id)
+		}
+		n++
+	}
+	if n > 0 {
+		j.down.Send(m)
+	}
+	return
+}
+
+type jobTable struct {
+	sync.Mutex
+	next  int
+	jobs  map[int]*Job
+	alloc sync.Mutex /* held from working out a job's nodes until it is in the table */
+}
+
+var jobs = &jobTable{next: 1, jobs: make(map[int]*Job)}
+
+/*
+ * Allocate works out the nodes of the exec request 'req', its node list
+ * and ranks, and puts the job in the table, all in one go, so that the
+ * nodes a count picks for it are the job's before anyone else's count
+ * can pick them.
+ */
+func (t *jobTable) Allocate(req *StartReq, down *downstream) (*Job, error) {
+	t.alloc.Lock()
+	defer t.alloc.Unlock()
+	err := resolveJobNodes(req)
+	if err == nil {
+		req.Ranks, req.RankAddrs, err = jobRanks(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.Add(req, down), nil
+}
+
+/* Add puts a new job, for the exec request 'req', in the table and gives req its id. */
+func (t *jobTable) Add(req *StartReq, down *downstream) *Job {
+	t.Lock()
+	defer t.Unlock()
+	j := &Job{Id: t.next, Uid: req.Uid, Gid: req.Gid, Args: req.Args, Nodes: req.Nodes,
+		Start: time.Now(), State: make(map[string]*jobNode), Detached: req.Detach,
+		lock: &sync.Mutex{}, down: down, done: make(chan bool), ranks: req.Ranks}
+	t.next++
+	t.jobs[j.Id] = j
+	req.JobId = j.Id
+	return j
+}
+
+func (t *jobTable) Remove(j *Job) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.jobs, j.Id)
+}
+
+/*
+ * Expire throws away a finished detached job, output and all, -jobkeep
+ * after it has finished, unless someone has waited for it by then.
+ */
+func (t *jobTable) Expire(j *Job) {
+	if *jobKeep <= 0 {
+		return
+	}
+	time.AfterFunc(*jobKeep, func() {
+		if _, ok := t.Get(j.Id); ok {
+			log_info("job ", j.Id, " was not waited for in ", *jobKeep, ", throwing it away")
+		}
+		t.Remove(j)
+		j.log.Remove()
+	})
+}
+
+func (t *jobTable) Get(id int) (j *Job, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	j, ok = t.jobs[id]
+	return
+}
+
+/* List returns copies of all the jobs, oldest first. */
+func (t *jobTable) List() (l []Job) {
+	t.Lock()
+	defer t.Unlock()
+	for id := 1; id < t.next; id++ {
+		if j, ok := t.jobs[id]; ok {
+			l = append(l, j.copy())
+		}
+	}
+	return
+}
+
+/*
+ * Busy returns the nodes that are busy with a job that has not finished:
+ * every node it was given, from the moment it was added to the table,
+ * and any others it has reached, until they have finished their part.
+ */
+func (t *jobTable) Busy() map[string]bool {
+	t.Lock()
+	defer t.Unlock()
+	busy := make(map[string]bool)
+	for _, j := range t.jobs {
+		j.lock.Lock()
+		if !j.Done {
+			for _, id := range j.ranks {
+				if n, ok := j.State[id]; !ok || n.State != "done" {
+					busy[id] = true
+				}
+			}
+			for id, n := range j.State {
+				if n.State != "done" {
+					busy[id] = true
+				}
+			}
+		}
+		j.lock.Unlock()
+	}
+	return busy
+}
+
+/* jobList is the master's answer to "gproc ps" and "gproc wait". */
+type jobList struct {
+	Jobs []Job
+	Msg  string
+}
+
+/*
+ * getJob finds the job a request is about, if the request's user may
+ * meddle with it: its owner and root may.
+ */
+func getJob(a *StartReq) (*Job, string) {
+	j, ok := jobs.Get(a.JobId)
+	switch {
+	case !ok:
+		return nil, fmt.Sprint("no job ", a.JobId)
+	case a.Uid != 0 && a.Uid != j.Uid:
+		return nil, fmt.Sprint("job ", a.JobId, " is not yours")
+	}
+	return j, ""
+}
+
+/* killJob is the master's end of "gproc kill". */
+func killJob(a *StartReq) Resp {
+	j, msg := getJob(a)
+	if j == nil {
+		return Resp{Msg: msg}
+	}
+	if len(a.Args) != 1 {
+		return Resp{Msg: "kill: want a signal"}
+	}
+	sig, err := strconv.Atoi(a.Args[0])
+	if err != nil {
+		return Resp{Msg: "bad signal " + a.Args[0]}
+	}
+	nodes, err := resolveNodes(a.Nodes)
+	if err != nil {
+		return Resp{Msg: "bad node list: " + err.Error()}
+	}
+	n, err := j.Signal(syscall.Signal(sig), nodes)
+	if err != nil {
+		return Resp{Msg: "bad node list: " + err.Error()}
+	}
+	return Resp{NumNodes: n, Msg: fmt.Sprint("signalled ", n, " nodes of job ", a.JobId)}
+}
+
+/*
+ * attachJobServer is the master's end of "gproc attach": it plays back
+ * the output of a detached job, from the start, and goes on relaying it
+ * until the job finishes or the client goes away.
+ */
+func attachJobServer(r *RpcClientServer, a *StartReq) {
+	j, msg := getJob(a)
+	switch {
+	case j == nil:
+		r.Send("attachJob", Resp{Msg: msg})
+		return
+	case j.log == nil:
+		r.Send("attachJob", Resp{Msg: fmt.Sprint("job ", a.JobId, " is not detached")})
+		return
+	}
+	r.Send("attachJob", Resp{NumNodes: len(j.copy().State), JobId: j.Id})
+	err := j.log.Replay(func(m *ioMsg) error {
+		return r.Send("attachJob", m)
+	})
+	if err == nil {
+		r.Send("attachJob", &ioMsg{Kind: ioDone})
+	}
+}
+
+/*
+ * waitJobServer is the master's end of "gproc wait". Once the job has
+ * finished it answers with the job, whose nodes hold their exit status;
+ * a finished detached job has then served its purpose and is removed.
+ */
+func waitJobServer(a *StartReq) jobList {
+	j, msg := getJob(a)
+	if j == nil {
+		return jobList{Msg: msg}
+	}
+	<-j.done
+	if j.log != nil {
+		jobs.Remove(j)
+		j.log.Remove()
+	}
+	return jobList{Jobs: []Job{j.copy()}}
+}
+
+/*
+ * Now the client end.
+ */
+
+/* dialMaster connects to the master and gets the vital data out of the way. */
+func dialMaster(masterAddr string) *RpcClientServer {
+	client, err := Dial("unix", "", masterAddr)
+	if err != nil {
+		log_error("dialing: ", masterAddr, " ", err)
+	}
+	r := NewRpcClientServer(client, *binRoot)
+	var vitalData vitalData
+	if r.Recv("vitalData", &vitalData) != nil {
+		log_error("Could not receive vital data")
+	}
+	return r
+}
+
+/*
+ * listJobs is "gproc ps". With no arguments it lists the master's jobs;
+ * given a job id it lists the state of each of that job's nodes.
+ */
+func listJobs(masterAddr string, args []string) int {
+	log.SetPrefix("ps " + *prefix + ": ")
+	r := dialMaster(masterAddr)
+	r.Send("listJobs", StartReq{Command: "ps"})
+	var l jobList
+	if r.Recv("listJobs", &l) != nil {
+		log_error("ps failed")
+	}
+	if len(args) == 0 {
+		fmt.Printf("%-6s %-6s %-20s %-12s %s\n", "JOB", "UID", "STARTED", "NODES", "COMMAND")
+		for _, j := range l.Jobs {
+			fmt.Printf("%-6d %-6d %-20s %-12s %s\n", j.Id, j.Uid, j.Start.Format("2006-01-02 15:04:05"), j.Nodes, strings.Join(j.Args, " "))
+			counts := make(map[string]int)
+			for _, s := range j.State {
+				counts[s.State]++
+			}
+			fmt.Printf("\t%d sent, ", counts["sent"])
+			if counts["staged"] > 0 {
+				fmt.Printf("%d staged, ", counts["staged"])
+			}
+			fmt.Printf("%d running, %d done", counts["running"], counts["done"])
+			if j.FailedBy != "" {
+				fmt.Print("; torn down after node ", j.FailedBy, " failed")
+			}
+			switch {
+			case j.Done:
+				fmt.Print("; finished, waiting for gproc wait")
+			case j.Detached:
+				fmt.Print("; detached")
+			}
+			fmt.Println()
+		}
+		return 0
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gproc: bad job id", args[0])
+		return 1
+	}
+	for _, j := range l.Jobs {
+		if j.Id != id {
+			continue
+		}
+		ids := nodeIds{}
+		for n := range j.State {
+			ids = append(ids, n)
+		}
+		sort.Sort(ids)
+		for _, n := range ids {
+			s := j.State[n]
+			if s.State == "done" {
+				fmt.Printf("%-12s %-30s %s\n", n, &s.Status, s.Status.Usage())
+			} else {
+				fmt.Printf("%-12s %s\n", n, s.State)
+			}
+		}
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "gproc: no job", id)
+	return 1
+}
+
+/* killJobs is "gproc kill <jobid> [nodes]"; the signal comes from -s. */
+func killJobs(masterAddr string, args []string) int {
+	log.SetPrefix("kill " + *prefix + ": ")
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gproc: bad job id", args[0])
+		return 1
+	}
+	sig, err := parseSignal(*killSignal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gproc:", err)
+		return 1
+	}
+	req := StartReq{Command: "kill", JobId: id, Args: []string{strconv.Itoa(int(sig))}}
+	if len(args) > 1 {
+		req.Nodes = args[1]
+	}
+	r := dialMaster(masterAddr)
+	r.Send("killJobs", req)
+	resp := &Resp{}
+	if r.Recv("killJobs", resp) != nil {
+		log_error("kill failed")
+	}
+	if resp.NumNodes == 0 {
+		fmt.Fprintln(os.Stderr, "gproc:", resp.Msg)
+		return 1
+	}
+	return 0
+}
+
+/*
+ * attachJob is "gproc attach <jobid>": it prints a detached job's output
+ * so far, then the rest as it comes, and exits with the job's status.
+ * Interrupting it leaves the job running.
+ */
+func attachJob(masterAddr, jobId string) int {
+	log.SetPrefix("attach " + *prefix + ": ")
+	id, err := strconv.Atoi(jobId)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gproc: bad job id", jobId)
+		return 1
+	}
+	r := dialMaster(masterAddr)
+	r.Send("attachJob", StartReq{Command: "attach", JobId: id})
+	resp := &Resp{}
+	if r.Recv("attachJob", resp) != nil {
+		log_error("attach failed")
+	}
+	if resp.JobId == 0 {
+		fmt.Fprintln(os.Stderr, "gproc:", resp.Msg)
+		return 1
+	}
+	return readOutput(r)
+}
+
+/* waitJob is "gproc wait <jobid>": it exits with the job's status once it has finished. */
+func waitJob(masterAddr, jobId string) int {
+	log.SetPrefix("wait " + *prefix + ": ")
+	id, err := strconv.Atoi(jobId)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gproc: bad job id", jobId)
+		return 1
+	}
+	r := dialMaster(masterAddr)
+	r.Send("waitJob", StartReq{Command: "wait", JobId: id})
+	var l jobList
+	if r.Recv("waitJob", &l) != nil {
+		log_error("wait failed")
+	}
+	if len(l.Jobs) == 0 {
+		fmt.Fprintln(os.Stderr, "gproc:", l.Msg)
+		return 1
+	}
+	/* a node that never got as far as exiting has been lost */
+	exits := newExitCollector()
+	for n, s := range l.Jobs[0].State {
+		exits.Write(&ioMsg{Kind: ioStarted, Id: n})
+		if s.State == "done" {
+			status := s.Status
+			exits.Write(&ioMsg{Kind: ioExit, Id: n, Status: &status})
+		}
+	}
+	if l.Jobs[0].FailedBy != "" {
+		exits.Write(&ioMsg{Kind: ioFailFast, Id: l.Jobs[0].FailedBy})
+	}
+	return exits.Summary(os.Stderr)
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+}
+
+/* parseSignal takes a signal number or name, with or without the SIG. */
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if strings.HasPrefix(name, "SIG") {
+		name = name[3:]
+	}
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	return 0, errors.New("unknown signal " + s)
+}
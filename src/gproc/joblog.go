@@ -0,0 +1,186 @@
+/*
+ * gproc, a Go reimplementation of the LANL version of bproc and the LANL XCPU software.
+ *
+ * This software is released under the GNU Lesser General Public License, version 2, incorporated herein by reference.
+ *
+ * Copyright (2010) Sandia Corporation. Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+ * the U.S. Government retains certain rights in this software.
+ */
+
+/*
+ * The output of detached jobs. Nobody is listening when a detached job
+ * writes, so the master keeps the job's ioMsgs in a jobLog until someone
+ * runs "gproc attach". The newest messages are kept in memory; once they
+ * take up more than -jobmem bytes the oldest are spilled to a file. Once
+ * the file holds -jobdisk bytes, the nodes' output is dropped, but not
+ * the rest, such as their exit status; each node whose output is cut
+ * short gets a note saying so instead.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+type jobLog struct {
+	sync.Mutex
+	cond     *sync.Cond
+	mem      []*ioMsg
+	memBytes int
+	spilled  int /* how many messages are in the file */
+	file     *os.File
+	size     int64           /* of the file */
+	dropped  map[string]bool /* the nodes whose output we have started dropping */
+	midLine  map[string]bool /* the nodes whose stderr so far does not end in a newline */
+	closed   bool
+	removed  bool
+}
+
+func newJobLog(id int) (*jobLog, error) {
+	f, err := ioutil.TempFile("", fmt.Sprint("gproc-job", id, "-"))
+	if err != nil {
+		return nil, err
+	}
+	l := &jobLog{file: f, dropped: make(map[string]bool), midLine: make(map[string]bool)}
+	l.cond = sync.NewCond(l)
+	return l, nil
+}
+
+/* Append adds m to the log, spilling old messages to the file if need be. */
+func (l *jobLog) Append(m *ioMsg) {
+	l.Lock()
+	defer l.Unlock()
+	if (m.Kind == ioStdout || m.Kind == ioStderr) && l.size >= *jobDisk {
+		if l.dropped[m.Id] {
+			return
+		}
+		l.dropped[m.Id] = true
+		log_info("jobLog: ", l.file.Name(), " is full, dropping the output of node ", m.Id)
+		note := fmt.Sprint("gproc: the rest of this node's output was dropped; the job's log is full at ", *jobDisk, " bytes\n")
+		if l.midLine[m.Id] {
+			note = "\n" + note
+		}
+		m = &ioMsg{Kind: ioStderr, Id: m.Id, Data: []byte(note)}
+	}
+	if m.Kind == ioStderr && len(m.Data) > 0 {
+		l.midLine[m.Id] = m.Data[len(m.Data)-1] != '\n'
+	}
+	l.mem = append(l.mem, m)
+	l.memBytes += len(m.Data)
+	for l.memBytes > *jobMem && len(l.mem) > 0 {
+		old := l.mem[0]
+		n, err := writeLogRecord(l.file, old)
+		l.size += n
+		if err != nil {
+			log_info("jobLog: spilling to ", l.file.Name(), ": ", err)
+			break
+		}
+		l.mem = l.mem[1:]
+		l.memBytes -= len(old.Data)
+		l.spilled++
+	}
+	l.cond.Broadcast()
+}
+
+/* Close says the job has finished: there will be no more messages. */
+func (l *jobLog) Close() {
+	l.Lock()
+	defer l.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+/* Remove throws the log away, file and all. */
+func (l *jobLog) Remove() {
+	l.Lock()
+	defer l.Unlock()
+	if l.removed {
+		return
+	}
+	l.file.Close()
+	os.Remove(l.file.Name())
+	l.mem = nil
+	l.removed = true
+}
+
+/*
+ * Replay hands every message in the log, from the first, to 'send', and
+ * goes on doing so as new ones arrive until the job has finished. It
+ * stops early if send fails.
+ */
+func (l *jobLog) Replay(send func(m *ioMsg) error) error {
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	var err error
+	for i := 0; err == nil; i++ {
+		l.Lock()
+		for i >= l.spilled+len(l.mem) && !l.closed {
+			l.cond.Wait()
+		}
+		if i >= l.spilled+len(l.mem) {
+			l.Unlock()
+			return nil
+		}
+		var m *ioMsg
+		if i >= l.spilled {
+			m = l.mem[i-l.spilled]
+		}
+		l.Unlock()
+		if m == nil {
+			/* the file only ever grows, so we can read it in order */
+			if f == nil {
+				if f, err = os.Open(l.file.Name()); err != nil {
+					break
+				}
+			}
+			m = &ioMsg{}
+			if err = readLogRecord(f, m); err != nil {
+				break
+			}
+		}
+		err = send(m)
+	}
+	return err
+}
+
+/*
+ * The file is a series of records, each a length and a gob of one ioMsg.
+ * Each gob stands alone so a reader can start at the beginning no matter
+ * how far the writer has got. writeLogRecord returns how many bytes it
+ * wrote.
+ */
+func writeLogRecord(w io.Writer, m *ioMsg) (int64, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(m); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(b.Len())); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b.Bytes())
+	return int64(4 + n), err
+}
+
+func readLogRecord(r io.Reader, m *ioMsg) error {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewBuffer(b)).Decode(m)
+}
@@ -0,0 +1,108 @@
+/*
+ * gproc, a Go reimplementation of the LANL version of bproc and the LANL XCPU software.
+ *
+ * This software is released under the GNU Lesser General Public License, version 2, incorporated herein by reference.
+ *
+ * Copyright (2010) Sandia Corporation. Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+ * the U.S. Government retains certain rights in this software.
+ */
+
+/*
+ * Node labels. Each slave tells its parent, when it registers, the labels
+ * it carries: arch, os, ncpu and mem, which it works out for itself, and
+ * whatever it is given with -label and -labelfile, such as rack=3 or gpu.
+ * They go up the tree with the rest of the nodeInfo, so the master can
+ * pick nodes by them: "gproc e @arch=arm,rack=3 ...".
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * nodeLabels is the labels of this node: the ones it works out for
+ * itself, then those of the -labelfile, then those of -label, each
+ * overriding the ones before.
+ */
+func nodeLabels() (map[string]string, error) {
+	labels := map[string]string{
+		"arch": runtime.GOARCH,
+		"os":   runtime.GOOS,
+		"ncpu": strconv.Itoa(runtime.NumCPU()),
+	}
+	if m := memTotal(); m > 0 {
+		labels["mem"] = formatSize(int64(m))
+	}
+	if *labelFile != "" {
+		b, err := ioutil.ReadFile(*labelFile)
+		if err != nil {
+			return nil, err
+		}
+		for i, l := range strings.Split(string(b), "\n") {
+			if l = strings.TrimSpace(l); l == "" || l[0] == '#' {
+				continue
+			}
+			if err := addLabel(labels, l); err != nil {
+				return nil, errors.New(fmt.Sprint(*labelFile, ":", i+1, ": ", err))
+			}
+		}
+	}
+	if *nodeLabelList != "" {
+		for _, l := range strings.Split(*nodeLabelList, ",") {
+			if err := addLabel(labels, strings.TrimSpace(l)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return labels, nil
+}
+
+/* addLabel adds a key=value label, or a bare key, which gets an empty value. */
+func addLabel(labels map[string]string, l string) error {
+	kv := strings.SplitN(l, "=", 2)
+	if !labelWord(kv[0]) || len(kv) == 2 && !labelWord(kv[1]) {
+		return errors.New("bad label " + l + ": want key=value, or key, of letters, digits, -, _ and .")
+	}
+	if len(kv) == 1 {
+		kv = append(kv, "")
+	}
+	labels[kv[0]] = kv[1]
+	return nil
+}
+
+/* labelWord says whether s can be a label's key or value, as node specs read them */
+func labelWord(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+/* formatLabels writes labels as key=value,key=value in key order, for "gproc i". */
+func formatLabels(labels map[string]string) string {
+	l := []string{}
+	for k, v := range labels {
+		if v == "" {
+			l = append(l, k)
+		} else {
+			l = append(l, k+"="+v)
+		}
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
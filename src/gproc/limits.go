@@ -0,0 +1,285 @@
+/*
+ * gproc, a Go reimplementation of the LANL version of bproc and the LANL XCPU software.
+ *
+ * This software is released under the GNU Lesser General Public License, version 2, incorporated herein by reference.
+ *
+ * Copyright (2010) Sandia Corporation. Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+ * the U.S. Government retains certain rights in this software.
+ */
+
+/*
+ * Resource limits for jobs. "gproc e -rlimit" names them, the StartReq
+ * carries them, and on each node a helper -- gproc itself, in role "L" --
+ * sets them and then execs the program. The slave cannot set them on
+ * itself first: they would apply to the slave too, and a Go program does
+ * not get far with its address space or thread count cut down to size.
+ *
+ * Limits on the program and everything it starts (-mem, -cpus, -pids)
+ * need a cgroup. A slave with a -cgroup makes one for each job under it,
+ * and the helper moves itself in before the exec, so that nothing the
+ * program starts can escape. The cgroup code itself is Linux only, and
+ * lives in bproc_linux.go.
+ *
+ * Last of all, the helper becomes the user the job belongs to. It has to
+ * be last: an ordinary user can neither join the cgroup nor, for some
+ * limits, do as the slave says. Only then does the job's environment
+ * come into it, with the exec.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+ * The program gets SIGXCPU when it has used its CPU time, and this many
+ * seconds more before the kernel kills it.
+ */
+const cpuGrace = 5
+
+/*
+ * parseRlimits parses the -rlimit list, e.g. "as=4G,cpu=1h,nofile=1024".
+ * Sizes may have a K, M, G or T suffix; cpu may be in seconds or a
+ * duration such as 90m.
+ */
+func parseRlimits(s string) (map[string]uint64, error) {
+	limits := make(map[string]uint64)
+	if s == "" {
+		return limits, nil
+	}
+	for _, l := range strings.Split(s, ",") {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("rlimit " + l + ": want name=value")
+		}
+		name := strings.ToLower(kv[0])
+		if _, ok := rlimitResources[name]; !ok {
+			return nil, errors.New("unknown rlimit " + kv[0])
+		}
+		v, err := parseRlimitValue(name, kv[1])
+		if err != nil {
+			return nil, errors.New("rlimit " + l + ": " + err.Error())
+		}
+		limits[name] = v
+	}
+	return limits, nil
+}
+
+func parseRlimitValue(name, s string) (uint64, error) {
+	if name == "cpu" {
+		if d, err := time.ParseDuration(s); err == nil {
+			return uint64(d / time.Second), nil
+		}
+	}
+	return parseSize(s)
+}
+
+/* parseSize parses a number with an optional K, M, G or T suffix, in powers of 1024. */
+func parseSize(s string) (uint64, error) {
+	mult := uint64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		case 't', 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[0 : n-1]
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("bad value " + s)
+	}
+	return v * mult, nil
+}
+
+/* formatRlimits is the inverse of parseRlimits, with the values in plain numbers. */
+func formatRlimits(limits map[string]uint64) string {
+	l := []string{}
+	for name, v := range limits {
+		l = append(l, fmt.Sprint(name, "=", v))
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+/*
+ * setRlimits sets the limits on the calling process. A limit can only
+ * be lowered: if the hard limit is already below what was asked for,
+ * that is what the program gets.
+ */
+func setRlimits(limits map[string]uint64) error {
+	for name, v := range limits {
+		res := rlimitResources[name]
+		var old syscall.Rlimit
+		if err := syscall.Getrlimit(res, &old); err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+		lim := syscall.Rlimit{Cur: v, Max: v}
+		if name == "cpu" {
+			lim.Max = v + cpuGrace
+		}
+		if lim.Max > old.Max {
+			lim.Max = old.Max
+		}
+		if lim.Cur > lim.Max {
+			lim.Cur = lim.Max
+		}
+		if err := syscall.Setrlimit(res, &lim); err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+/* A cgroup is the one a slave has made for a job. */
+type cgroup struct {
+	dir string
+}
+
+/* helperPath is where runLocal finds gproc to run the limit helper. */
+func helperPath() string {
+	p, err := filepath.Abs(*gprocBin)
+	if err != nil {
+		return *gprocBin
+	}
+	return p
+}
+
+/* formatCredentials writes uid, gid and groups for -runAs, e.g. 100:100:100,20 */
+func formatCredentials(uid, gid int, groups []int) string {
+	g := []string{}
+	for _, n := range groups {
+		g = append(g, strconv.Itoa(n))
+	}
+	return fmt.Sprint(uid, ":", gid, ":", strings.Join(g, ","))
+}
+
+/* setCredentials gives us the groups, gid and uid in a -runAs, in that order. */
+func setCredentials(cred string) error {
+	f := strings.Split(cred, ":")
+	if len(f) != 3 {
+		return errors.New("want uid:gid:groups")
+	}
+	uid, err := strconv.Atoi(f[0])
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(f[1])
+	if err != nil {
+		return err
+	}
+	groups := []int{}
+	if f[2] != "" {
+		for _, g := range strings.Split(f[2], ",") {
+			n, err := strconv.Atoi(g)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, n)
+		}
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+/*
+ * limitHelper is gproc in role "L": it sets the -rlimit limits on itself,
+ * joins the -cgroupJoin cgroup, takes on the -runAs identity, and becomes
+ * the program at 'execpath', with the environment from -envFd. It only
+ * returns if that fails, with the exit status a shell would use for a
+ * program it cannot run.
+ */
+func limitHelper(execpath string, argv []string) int {
+	env := os.Environ()
+	if *envFd >= 0 {
+		f := os.NewFile(uintptr(*envFd), "env")
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gproc: reading the environment:", err)
+			return 127
+		}
+		env = []string{}
+		if len(b) > 0 {
+			env = strings.Split(string(b), "\x00")
+		}
+	}
+	limits, err := parseRlimits(*rlimits)
+	if err == nil {
+		err = setRlimits(limits)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gproc: setting rlimits:", err)
+		return 127
+	}
+	if *cgroupJoin != "" {
+		if err = joinCgroup(*cgroupJoin); err != nil {
+			fmt.Fprintln(os.Stderr, "gproc: joining cgroup:", err)
+			return 127
+		}
+	}
+	if *runAs != "" {
+		if err = setCredentials(*runAs); err != nil {
+			fmt.Fprintln(os.Stderr, "gproc: becoming", *runAs+":", err)
+			return 127
+		}
+	}
+	err = syscall.Exec(execpath, argv, env)
+	fmt.Fprintln(os.Stderr, "gproc: exec", execpath+":", err)
+	return 127
+}
+
+/*
+ * limitExceeded says which limit, if any, the program was killed for
+ * exceeding. Only cpu and fsize end in a signal of their own; running
+ * out of as, nofile or nproc makes system calls fail, and the program
+ * reports that itself. A shell exiting with 128 plus one of those
+ * signals is passing on the news from one of its children.
+ */
+func limitExceeded(limits map[string]uint64, w *os.ProcessState) string {
+	ws, ok := w.Sys().(syscall.WaitStatus)
+	if !ok {
+		return ""
+	}
+	var sig syscall.Signal
+	switch {
+	case ws.Signaled():
+		sig = ws.Signal()
+	case ws.ExitStatus() == 128+int(syscall.SIGXCPU), ws.ExitStatus() == 128+int(syscall.SIGXFSZ):
+		sig = syscall.Signal(ws.ExitStatus() - 128)
+	default:
+		return ""
+	}
+	if cpu, ok := limits["cpu"]; ok {
+		used := w.UserTime() + w.SystemTime()
+		if sig == syscall.SIGXCPU || (sig == syscall.SIGKILL && used >= time.Duration(cpu)*time.Second) {
+			return "cpu"
+		}
+	}
+	if _, ok := limits["fsize"]; ok && sig == syscall.SIGXFSZ {
+		return "fsize"
+	}
+	return ""
+}
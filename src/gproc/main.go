@@ -16,13 +16,19 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 func usage() {
 	fmt.Fprint(os.Stderr, "usage: gproc m\n")
 	fmt.Fprint(os.Stderr, "usage: gproc s\n")
 	fmt.Fprint(os.Stderr, "usage: gproc e <nodes> <command>\n")
-	fmt.Fprint(os.Stderr, "usage: gproc i [i ...] goes one level deeper for each i\n")
+	fmt.Fprint(os.Stderr, "usage: gproc i [nodes]\n")
+	fmt.Fprint(os.Stderr, "usage: gproc groups [name ...]\n")
+	fmt.Fprint(os.Stderr, "usage: gproc ps [jobid]\n")
+	fmt.Fprint(os.Stderr, "usage: gproc [-s signal] kill <jobid> [nodes]\n")
+	fmt.Fprint(os.Stderr, "usage: gproc attach <jobid>\n")
+	fmt.Fprint(os.Stderr, "usage: gproc wait <jobid>\n")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -43,10 +49,44 @@ var (
 	cmdPort          = flag.String("cmdport", "6666", "command port")
 	defaultFam       = flag.String("fam", "tcp4", "network type")
 	gprocBin         = flag.String("gprocBin", "gproc", "name of gproc binary")
+	stdinTo          = flag.String("stdin", "all", "where stdin goes: all, none, or a single node id")
+	labelOutput      = flag.Bool("l", false, "prefix each line of output with the node it came from")
+	groupOutput      = flag.Bool("b", false, "hold output until the end and print nodes with identical output together")
+	killSignal       = flag.String("s", "TERM", "signal for gproc kill to send")
+	detach           = flag.Bool("d", false, "detach: start the job, print its id and leave it to the master")
+	dryRun           = flag.Bool("n", false, "dry run: list the nodes the job would run on and the files it would send, and stop")
+	ttyMode          = flag.Bool("tty", false, "give the program a terminal, and make ours raw while it runs; for one node only")
+	jobFile          = flag.String("job", "", "file of <nodes> <command> [args] lines, one for each group of nodes of an MPMD job")
+	staged           = flag.Bool("stage", false, "send the files to every node first, then start the program everywhere at once")
+	failFast         = flag.Bool("fail-fast", false, "kill the whole job as soon as any node fails or is lost")
+	timeLimit        = flag.Duration("t", 0, "wall-clock time limit for the job on each node, e.g. 90s or 2h; 0 for none")
+	killGrace        = flag.Duration("grace", 10*time.Second, "how long a timed-out job gets between SIGTERM and SIGKILL")
+	rlimits          = flag.String("rlimit", "", "resource limits for the job on each node, e.g. as=4G,cpu=1h,nofile=1024,core=0,nproc=512")
+	memoryMax        = flag.String("mem", "", "memory limit for the job on each node, program and children together, e.g. 4G")
+	cpus             = flag.Float64("cpus", 0, "CPU limit for the job on each node, in CPUs, e.g. 1.5")
+	pidsMax          = flag.Int("pids", 0, "limit on the number of processes of the job on each node")
+	showUsage        = flag.Bool("usage", false, "list the peak memory and CPU time of each node at the end")
+	cgroupParent     = flag.String("cgroup", "", "cgroup v2 directory under which the slave makes a cgroup for each job")
+	jobMem           = flag.Int("jobmem", 1<<20, "bytes of a detached job's output the master keeps in memory before spilling to disk")
+	jobDisk          = flag.Int64("jobdisk", 1<<30, "bytes of a detached job's output the master spills to disk before dropping the rest")
+	jobKeep          = flag.Duration("jobkeep", 24*time.Hour, "how long the master keeps a finished detached job nobody has waited for; 0 for ever")
+	exportAll        = flag.Bool("export-all", false, "give the job all of our environment")
+	subDir           = flag.String("cwd", "", "directory under ours for the job to run in on each node; may hold placeholders")
+	outDir           = flag.String("o", "", "write each node's output to <node>.out and <node>.err in this directory, and a summary to summary")
+	tee              = flag.Bool("tee", false, "with -o, write the output to the terminal as well")
+	hostname         = flag.String("hostname", "", "the name a slave goes by in node lists, if not its host name")
+	nodeLabelList    = flag.String("label", "", "labels for a slave to carry, as well as arch, os, ncpu and mem, e.g. rack=3,gpu")
+	labelFile        = flag.String("labelfile", "", "file of labels for a slave to carry, key=value or key, one to a line")
+	connectWait      = flag.Duration("connectwait", time.Minute, "how long a node has, once a job's files have reached it, to connect back for the job's output before it is given up for lost")
+	groupsFile       = flag.String("groups", "", "file of named node groups for the master, name = nodes, one to a line; reread on SIGHUP")
 	/* required in the command line */
 	parent    = flag.String("myParent", "hostname", "parent for some configurations")
 	myAddress = flag.String("myAddress", "hostname", "Required set to my address")
 	myId      = flag.String("myId", "0", "Required -- tell slaves their id")
+	/* for the limit helper */
+	cgroupJoin = flag.String("cgroupJoin", "", "cgroup to put the program in")
+	runAs      = flag.String("runAs", "", "uid:gid:groups to run the program as")
+	envFd      = flag.Int("envFd", -1, "fd to read the program's environment from, NUL separated")
 	/* these are not switches */
 	role            = "client"
 	myListenAddress string
@@ -62,6 +102,17 @@ var (
  *  ./gproc_linux_arm -parent='hostname base 7 roundup sb strcat 10.1.1.1 hostname base 7 % ifelse' -myId='hostname base 7 % 1  + hostname base 7 / hostname base 7 % ifelse' -myAddress=hostname s
  * is used for strongbox, where there is a single root, 49 level 1s defined by name %7 == 0, and 
  */
+/* -env and -export may be given more than once */
+var (
+	setVars    envList
+	exportVars envList
+)
+
+func init() {
+	flag.Var(&setVars, "env", "NAME=VALUE to set in the job's environment; may be repeated")
+	flag.Var(&exportVars, "export", "comma-separated names of our environment variables to give the job; may be repeated")
+}
+
 func main() {
 	var err error
 	flag.Usage = usage
@@ -98,17 +149,26 @@ func main() {
 		}
 		runSlave()
 	case "EXEC", "exec", "e":
-		/* Issuing a command to run on the slaves */
-		if len(flag.Args()) < 3 {
+		/* Issuing a command to run on the slaves; with -job, the nodes and commands are in the file */
+		switch {
+		case *jobFile != "" && len(flag.Args()) != 1, *jobFile == "" && len(flag.Args()) < 3:
 			flag.Usage()
 		}
-		startExecution(*defaultMasterUDS, *defaultFam, *ioProxyPort, flag.Arg(1), flag.Args()[2:])
+		var cmd []string
+		if len(flag.Args()) > 2 {
+			cmd = flag.Args()[2:]
+		}
+		os.Exit(startExecution(*defaultMasterUDS, flag.Arg(1), cmd))
 	case "INFO", "info", "i":
-		/* Get info about the available nodes */
-		if len(flag.Args()) > 1 {
+		/* Get info about the available nodes, or the ones named */
+		if len(flag.Args()) > 2 {
 			flag.Usage()
 		}
 		info := getInfo(*defaultMasterUDS, flag.Arg(1))
+		if info.NumNodes == 0 && info.Msg != "" {
+			fmt.Fprintln(os.Stderr, "gproc:", info.Msg)
+			os.Exit(1)
+		}
 		fmt.Print("Nodes:\n", info)
 		/* not yet
 		case "EXCEPT", "except", "x":
@@ -116,6 +176,39 @@ func main() {
 		exceptOK := except(*defaultMasterUDS, flag.Args()[1:])
 		fmt.Print(exceptOK)
 		*/
+	case "GROUPS", "groups":
+		/* List the master's node groups */
+		os.Exit(listGroups(*defaultMasterUDS, flag.Args()[1:]))
+	case "PS", "ps":
+		/* List the master's jobs */
+		if len(flag.Args()) > 2 {
+			flag.Usage()
+		}
+		os.Exit(listJobs(*defaultMasterUDS, flag.Args()[1:]))
+	case "KILL", "kill":
+		/* Signal a job */
+		if len(flag.Args()) < 2 || len(flag.Args()) > 3 {
+			flag.Usage()
+		}
+		os.Exit(killJobs(*defaultMasterUDS, flag.Args()[1:]))
+	case "ATTACH", "attach":
+		/* Watch the output of a detached job */
+		if len(flag.Args()) != 2 {
+			flag.Usage()
+		}
+		os.Exit(attachJob(*defaultMasterUDS, flag.Arg(1)))
+	case "WAIT", "wait":
+		/* Wait for a job to finish and exit with its status */
+		if len(flag.Args()) != 2 {
+			flag.Usage()
+		}
+		os.Exit(waitJob(*defaultMasterUDS, flag.Arg(1)))
+	case "L":
+		/* This is for setting resource limits on a program and then running it */
+		if len(flag.Args()) < 3 {
+			flag.Usage()
+		}
+		os.Exit(limitHelper(flag.Arg(1), flag.Args()[2:]))
 	case "R":
 		/* This is for executing a program from the slave */
 		slaveProc(NewRpcClientServer(os.Stdin, *binRoot), &RpcClientServer{E: gob.NewEncoder(os.Stdout), D: gob.NewDecoder(os.Stdout)}, &RpcClientServer{E: gob.NewEncoder(os.NewFile(3, "pipe")), D: gob.NewDecoder(os.NewFile(3, "pipe"))})
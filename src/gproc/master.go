@@ -10,7 +10,18 @@
 package main
 
 import (
+	"bitbucket.org/floren/gproc/src/filemarshal"
+	"bitbucket.org/floren/gproc/src/nodespec"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 )
 
 var (
@@ -18,6 +29,8 @@ var (
 	netaddr     = ""
 	exceptFiles map[string]bool
 	exceptList  []string
+	/* exceptFiles and exceptList are shared by every connection */
+	exceptLock sync.Mutex
 )
 
 func startMaster() {
@@ -25,13 +38,19 @@ func startMaster() {
 	log_info("starting master")
 	exceptFiles = make(map[string]bool, 16)
 	exceptList = []string{}
+	if *groupsFile != "" {
+		if err := nodeGroups.Load(*groupsFile); err != nil {
+			log_error("groups: ", err)
+		}
+		go reloadGroups(*groupsFile)
+	}
 
 	//go web()
 	go receiveCmds(*defaultMasterUDS)
 	registerSlaves()
 }
 
-func sendCommandsToANodeSet(sendReq *StartReq, subNodes string, root string, nodeSet []string) (numnodes int) {
+func sendCommandsToANodeSet(sendReq *StartReq, subNodes string, root string, nodeSet []server, sent func(err error)) (numnodes int) {
 	/* for efficiency, on the slave node, if there is one proc, 
 	 * it connects directly to the parent IO forwarder. 
 	 * If the slave node is tasking other nodes, it will also spawn
@@ -49,16 +68,16 @@ func sendCommandsToANodeSet(sendReq *StartReq, subNodes string, root string, nod
 
 	sendReq.Nodes = subNodes
 	for _, s := range nodeSet {
-		if cacheRelayFilesAndDelegateExec(sendReq, root, s) == nil {
+		if cacheRelayFilesAndDelegateExec(sendReq, root, s, sent) == nil {
 			numnodes += connsperNode
 		} else {
-			log_info(s, " failed")
-			si, ok := slaves.Get(s)
+			log_info(s.Addr, " failed")
+			si, ok := slaves.Get(s.Addr)
 			if ok {
 				log_info("Remove slave ", s, " ", si)
 				slaves.Remove(si)
 			} else {
-				log_info("Could not find slave ", s, " to remove")
+				log_info("Could not find slave ", s.Addr, " to remove")
 			}
 		}
 	}
@@ -69,42 +88,298 @@ func sendCommandsToANodeSet(sendReq *StartReq, subNodes string, root string, nod
 /*
  * The master calls this to distribute commands and files to its sub-nodes
  */
-func sendCommandsToNodes(r *RpcClientServer, sendReq *StartReq, root string) (numnodes int) {
-	slaveNodes, err := parseNodeList(sendReq.Nodes)
-	log_info("receiveCmds: sendReq.Nodes: ", sendReq.Nodes, " expands to ", slaveNodes)
+func sendCommandsToNodes(r *RpcClientServer, sendReq *StartReq, root string, job *Job) (sent []string) {
+	nodes, err := delegate(sendReq.Nodes, slaves.Servers())
+	log_info("receiveCmds: sendReq.Nodes: ", sendReq.Nodes, " goes to ", nodes)
 	if err != nil {
 		r.Send("receiveCmds", Resp{NumNodes: 0, Msg: "startExecution: bad slaveNodeList: " + err.Error()})
 		return
 	}
-	for _, aNode := range slaveNodes {
+	for _, n := range nodes {
 		/* would be nice to spawn these async but we need the 
 		 * nodecount ...
 		 */
-		nodeSet := slaves.ServIntersect(aNode.Nodes)
-		numnodes += sendCommandsToANodeSet(sendReq, aNode.Subnodes, root, nodeSet)
+		id := n.Id
+		if sendCommandsToANodeSet(sendReq, n.Subnodes, root, []server{n.Server}, func(err error) { job.down.Sent(id, err) }) > 0 {
+			sent = append(sent, n.Id)
+			job.sent(n.Id)
+		}
 	}
-	log_info("numnodes = ", numnodes)
+	log_info("numnodes = ", len(sent))
 	return
 }
 
+/*
+ * peerCred is who is at the other end of a connection to the master's
+ * socket. Where the kernel cannot tell us, it is taken to be whoever is
+ * running the master -- unless that is root, when nobody gets in.
+ */
+func peerCred(c net.Conn) (uid, gid int, groups []int, err error) {
+	uid, gid, groups, err = ucred(c)
+	if err == nil {
+		return
+	}
+	if os.Getuid() == 0 {
+		return
+	}
+	log_info("peerCred: ", err, "; running jobs as ", os.Getuid())
+	groups, _ = os.Getgroups()
+	return os.Getuid(), os.Getgid(), groups, nil
+}
+
+/*
+ * checkFiles makes the files an exec request ships its user's: the nodes
+ * write each of them as owned by the user, and the master, which reads
+ * them for the job and may read anything, only ships those the user may
+ * read. Nor may a file's name take it out of the nodes' -binRoot, nor
+ * the working directory, which the nodes go to before the job is its
+ * user's.
+ */
+func checkFiles(a *StartReq) error {
+	if err := filemarshal.CheckName(a.Cwd); err != nil {
+		return errors.New("working directory " + err.Error())
+	}
+	for _, g := range a.split() {
+		for _, c := range g.Cmds {
+			if err := filemarshal.CheckName(c.DestName); err != nil {
+				return err
+			}
+			c.Uid, c.Gid = a.Uid, a.Gid
+			if c.Ftype == 0 && a.Uid != 0 && !mayRead(c.DestName, a.Uid, a.Gid, a.Groups) {
+				return errors.New(c.DestName + ": permission denied")
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * mayRead says whether the user with the given uid, gid and groups may
+ * read the file 'name', by its mode and those of the directories on the
+ * way to it, following any links.
+ */
+func mayRead(name string, uid, gid int, groups []int) bool {
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return false
+	}
+	allowed := func(p string, bit os.FileMode) bool {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return false
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		mode := fi.Mode().Perm()
+		if int(st.Uid) == uid {
+			return mode&(bit<<6) != 0
+		}
+		ingroup := int(st.Gid) == gid
+		for _, g := range groups {
+			ingroup = ingroup || int(st.Gid) == g
+		}
+		if ingroup {
+			return mode&(bit<<3) != 0
+		}
+		return mode&bit != 0
+	}
+	dir := "/"
+	for _, e := range strings.Split(filepath.Dir(real), "/") {
+		dir = filepath.Join(dir, e)
+		if !allowed(dir, 01) {
+			return false
+		}
+	}
+	return allowed(real, 04)
+}
+
+/*
+ * namedNodes is the nodes of a job its node list names itself, leaving
+ * out those that only run it because they are on the way to one: for
+ * 1/5, 1/5 but not 1.
+ */
+func namedNodes(a *StartReq) (named []string) {
+	spec, err := nodespec.Parse(a.Nodes)
+	if err != nil {
+		return
+	}
+	for _, id := range a.Ranks {
+		if spec.Names(id) {
+			named = append(named, id)
+		}
+	}
+	return
+}
+
+/*
+ * runJob runs an exec request. The master is the root of the tree of
+ * ioProxies: the nodes' output comes up to it and goes on to the gproc
+ * that asked for the exec over the Unix domain socket, and stdin and
+ * signals come back down the same way. If that gproc goes away before
+ * the job is done, the job gets a SIGHUP, as it would from a terminal.
+ * While it runs, the job is in the job table.
+ */
+func runJob(r *RpcClientServer, a *StartReq) {
+	for _, g := range a.split() {
+		if len(g.Args) == 0 {
+			r.Send("runJob", Resp{Msg: "runJob: no command to run"})
+			return
+		}
+	}
+	if err := checkFiles(a); err != nil {
+		r.Send("runJob", Resp{Msg: "runJob: " + err.Error()})
+		return
+	}
+	var job *Job
+	deliver := func(m *ioMsg) {
+		if job.log != nil {
+			job.log.Append(m)
+		} else {
+			r.Send("runJob", m)
+		}
+	}
+	workerChan, l, down, err := ioProxy(*defaultFam, netaddr+":"+*ioProxyPort, func(m *ioMsg) {
+		job.update(m)
+		if m.Kind == ioReady || m.Kind == ioStaged {
+			return
+		}
+		deliver(m)
+		if a.FailFast && m.Kind == ioExit && m.Status.Failed() && job.failed(m.Id, a.KillGrace) {
+			deliver(&ioMsg{Kind: ioFailFast, Id: m.Id})
+		}
+	})
+	if err != nil {
+		r.Send("runJob", Resp{Msg: "runJob: ioproxy: " + err.Error()})
+		return
+	}
+	defer l.Close()
+	if job, err = jobs.Allocate(a, down); err != nil {
+		r.Send("runJob", Resp{Msg: "bad node list: " + err.Error()})
+		return
+	}
+	if a.Tty && a.Detach {
+		/* nobody would be there to read the terminal */
+		jobs.Remove(job)
+		r.Send("runJob", Resp{Msg: "-tty and -d do not go together"})
+		return
+	}
+	if a.Tty {
+		/*
+		 * one terminal, one program at the other end of it. The nodes on
+		 * the way to it run the job too, as always, but without the
+		 * terminal, and so without our stdin
+		 */
+		named := namedNodes(a)
+		if len(named) != 1 {
+			jobs.Remove(job)
+			r.Send("runJob", Resp{Msg: fmt.Sprint("-tty needs a node list naming one node, not ", len(named))})
+			return
+		}
+		a.Stdin = named[0]
+	}
+	if a.Detach {
+		/* nobody will feed it stdin once the client has gone */
+		a.Stdin = "none"
+		if job.log, err = newJobLog(job.Id); err != nil {
+			jobs.Remove(job)
+			r.Send("runJob", Resp{Msg: "runJob: job log: " + err.Error()})
+			return
+		}
+	}
+	if a.Staged {
+		job.stage = newStage()
+	}
+	a.Lfam = l.Addr().Network()
+	a.Lserver = l.Addr().String()
+	/* each group of an MPMD job goes only to its own nodes */
+	sent := []string{}
+	for _, g := range a.split() {
+		sent = append(sent, sendCommandsToNodes(r, g, "", job)...)
+	}
+	numnodes := len(sent)
+	ranks := append(nodeIds{}, a.Ranks...)
+	sort.Sort(ranks)
+	r.Send("receiveCmds", Resp{NumNodes: numnodes, Msg: "sendCommandsToNodes finished", JobId: job.Id, Nodes: nodeRanges(ranks)})
+	if numnodes == 0 {
+		job.finish()
+		jobs.Remove(job)
+		return
+	}
+	down.Expect(sent)
+
+	/* stdin and signals go down from the start: a node signalled while the job is staged never starts */
+	finished := make(chan bool, 1)
+	if !a.Detach {
+		go func() {
+			for {
+				m := &ioMsg{}
+				if r.Recv("runJob", m) != nil {
+					break
+				}
+				down.Send(m)
+			}
+			select {
+			case <-finished:
+			default:
+				log_info("runJob: client went away, hanging up the job")
+				down.Send(&ioMsg{Kind: ioSignal, Sig: int(syscall.SIGHUP)})
+			}
+		}()
+	}
+	if job.stage != nil {
+		/* the files are everywhere now; start the program everywhere at once */
+		job.stage.Wait()
+		log_info("runJob: job ", job.Id, " is ready on every node, go")
+		down.Send(&ioMsg{Kind: ioGo})
+	}
+	for ; numnodes > 0; numnodes-- {
+		<-workerChan
+	}
+	job.finish()
+	if a.Detach {
+		/* the job stays in the table until someone waits for it, or -jobkeep has gone by */
+		jobs.Expire(job)
+		return
+	}
+	finished <- true
+	r.Send("runJob", &ioMsg{Kind: ioDone})
+	jobs.Remove(job)
+}
+
 /*
  * The master sits in a loop listening for commands to come in over the Unix domain socket.
  */
 func receiveCmds(domainSock string) error {
-	vitalData := vitalData{HostAddr: "", HostReady: false, Error: "No hosts ready", Exceptlist: exceptFiles}
+	vital := vitalData{HostAddr: "", HostReady: false, Error: "No hosts ready"}
 	l, err := Listen("unix", *defaultMasterUDS)
 	if err != nil {
 		log_error("listen error:", err)
 	}
+	/* anyone may connect; what they may do is up to their credentials */
+	os.Chmod(*defaultMasterUDS, 0777)
 	for {
 		c, err := l.Accept()
 		if err != nil {
 			log_error("receiveCmds: accept on (%v) failed %v\n", l, err)
 		}
-		r := NewRpcClientServer(c, *binRoot)
+		uid, gid, groups, err := peerCred(c)
+		if err != nil {
+			log_info("receiveCmds: refusing connection: ", err)
+			c.Close()
+			continue
+		}
+		/* no root: the master takes no files from anyone */
+		r := NewRpcClientServer(c, "")
 		go func() {
 			var a StartReq
 
+			defer c.Close()
+			vitalData := vital
+			exceptLock.Lock()
+			vitalData.Exceptlist = make(map[string]bool, len(exceptFiles))
+			for s := range exceptFiles {
+				vitalData.Exceptlist[s] = true
+			}
+			exceptLock.Unlock()
 			if netaddr != "" {
 				vitalData.HostReady = true
 				vitalData.Error = ""
@@ -116,10 +391,22 @@ func receiveCmds(domainSock string) error {
 			if err != nil {
 				return
 			}
+			/* whatever the client says, it runs things as who it really is */
+			a.Uid, a.Gid, a.Groups = uid, gid, groups
+			if a.Command == "" {
+				r.Send("unknown command", Resp{Msg: "unknown command"})
+				return
+			}
 			/* we could used re matching but that package is a bit big */
 			switch {
 			case a.Command[0] == uint8('x'):
 				{
+					/* the list is for everyone's jobs, so only root or whoever runs the master may change it */
+					if a.Uid != 0 && a.Uid != os.Getuid() {
+						r.Send("exceptOK", Resp{Msg: "except: permission denied"})
+						break
+					}
+					exceptLock.Lock()
 					for _, s := range a.Args {
 						exceptFiles[s] = true
 					}
@@ -127,6 +414,7 @@ func receiveCmds(domainSock string) error {
 					for s, _ := range exceptFiles {
 						exceptList = append(exceptList, s)
 					}
+					exceptLock.Unlock()
 					exceptOK := Resp{Msg: "Files accepted"}
 					log_info("Respond to except request ", exceptOK)
 					r.Send("exceptOK", exceptOK)
@@ -134,10 +422,16 @@ func receiveCmds(domainSock string) error {
 			case a.Command[0] == uint8('i'):
 				{
 					hostinfo := Resp{}
-					for i, s := range slaves.Addr2id {
-						hostinfo.Msg += i + " " + s + "\n"
+					if a.Nodes != "" {
+						hostinfo = nodeInfoList(a.Nodes)
+						r.Send("hostinfo", hostinfo)
+						break
 					}
-					hostinfo.NumNodes = len(slaves.Addr2id)
+					l := slaves.List()
+					for _, s := range l {
+						hostinfo.Msg += s.Server + " " + s.Id + " " + s.Hostname + " " + formatLabels(s.Labels) + "\n"
+					}
+					hostinfo.NumNodes = len(l)
 					log_info("Respond to info request ", hostinfo)
 					r.Send("hostinfo", hostinfo)
 				}
@@ -146,8 +440,43 @@ func receiveCmds(domainSock string) error {
 					if !vitalData.HostReady {
 						return
 					}
-					numnodes := sendCommandsToNodes(r, &a, "")
-					r.Send("receiveCmds", Resp{NumNodes: numnodes, Msg: "sendCommandsToNodes finished"})
+					runJob(r, &a)
+				}
+			case a.Command[0] == uint8('n'):
+				{
+					var l nodeList
+					if err = resolveJobNodes(&a); err == nil {
+						l.Ids, l.Addrs, err = jobRanks(&a)
+					}
+					if err != nil {
+						l.Msg = "bad node list: " + err.Error()
+					}
+					nodes := make(map[string]nodeInfo)
+					nodeTable("", slaves.Tree(), nodes)
+					for _, id := range l.Ids {
+						l.Hosts = append(l.Hosts, nodes[id].Hostname)
+					}
+					r.Send("nodeList", l)
+				}
+			case a.Command[0] == uint8('g'):
+				{
+					r.Send("groupList", listGroupsServer())
+				}
+			case a.Command[0] == uint8('p'):
+				{
+					r.Send("jobList", jobList{Jobs: jobs.List()})
+				}
+			case a.Command[0] == uint8('k'):
+				{
+					r.Send("killJob", killJob(&a))
+				}
+			case a.Command[0] == uint8('a'):
+				{
+					attachJobServer(r, &a)
+				}
+			case a.Command[0] == uint8('w'):
+				{
+					r.Send("waitJob", waitJobServer(&a))
 				}
 			default:
 				{
@@ -158,3 +487,27 @@ func receiveCmds(domainSock string) error {
 	}
 	return nil
 }
+
+/*
+ * nodeInfoList is the master's answer to "gproc i <nodes>": a line for
+ * each node the node list names, at whatever level, with its address,
+ * id, host name and labels.
+ */
+func nodeInfoList(spec string) (info Resp) {
+	spec, err := resolveNodes(spec)
+	var ids []string
+	if err == nil {
+		ids, _, err = rankNodes(spec)
+	}
+	if err != nil {
+		return Resp{Msg: "bad node list: " + err.Error()}
+	}
+	nodes := make(map[string]nodeInfo)
+	nodeTable("", slaves.Tree(), nodes)
+	for _, id := range ids {
+		n := nodes[id]
+		info.Msg += n.Addr + " " + id + " " + n.Hostname + " " + formatLabels(n.Labels) + "\n"
+	}
+	info.NumNodes = len(ids)
+	return
+}
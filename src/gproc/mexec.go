@@ -19,10 +19,13 @@ package main
 
 import (
 	"bitbucket.org/floren/gproc/src/ldd"
+	"bitbucket.org/floren/gproc/src/nodespec"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
@@ -31,14 +34,15 @@ import (
 
 /*
  * This function is called when you give gproc an "e" argument, in order to run a specified
- * command on the selected nodes
+ * command on the selected nodes. It returns the exit status for gproc: non-zero if
+ * the command failed on any node.
  */
-func startExecution(masterAddr, fam, ioProxyPort, slaveNodes string, cmd []string) {
+func startExecution(masterAddr, slaveNodes string, cmd []string) int {
 	log.SetPrefix("mexec " + *prefix + ": ")
 	/* make sure there is someone to talk to, and get the vital data */
 	client, err := Dial("unix", "", masterAddr)
 	if err != nil {
-		log_error("startExecution: dialing: ", fam, " ", masterAddr, " ", err)
+		log_error("startExecution: dialing: ", masterAddr, " ", err)
 	}
 	r := NewRpcClientServer(client, *binRoot)
 
@@ -47,8 +51,218 @@ func startExecution(masterAddr, fam, ioProxyPort, slaveNodes string, cmd []strin
 	if r.Recv("vitalData", &vitalData) != nil {
 		log_error("Can't get vital data from master")
 	}
-	pv := newPackVisitor()
+	groups, err := mpmdGroups(slaveNodes, cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gproc:", err)
+		return 1
+	}
 	cwd, _ := os.Getwd()
+	excepted := []string{}
+	for i := range groups {
+		excepted = append(excepted, packGroup(&groups[i], cwd, vitalData.Exceptlist)...)
+	}
+	/* build the library list given that we may have a different root */
+
+	libList := strings.SplitN(*libs, ":", -1)
+	rootedLibList := []string{}
+	for _, s := range libList {
+		log_info("startExecution: add lib ", s)
+		rootedLibList = append(rootedLibList, fmt.Sprintf("%s/%s", *root, s))
+	}
+	/* this test could be earlier. We leave it all the way down here so we can 
+	 * easily test the library code. Later, it can move
+	 * earlier in the code. 
+	 */
+	if !vitalData.HostReady {
+		log_info("Can not start jobs: ", vitalData.Error)
+		fmt.Fprintln(os.Stderr, "gproc: can not start jobs:", vitalData.Error)
+		return 1
+	}
+	log_info("startExecution: libList ", libList)
+	limits, err := parseRlimits(*rlimits)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gproc:", err)
+		return 1
+	}
+	for _, e := range setVars {
+		if !strings.Contains(e, "=") {
+			fmt.Fprintln(os.Stderr, "gproc: -env", e+": want NAME=VALUE")
+			return 1
+		}
+	}
+	if *subDir != "" {
+		if err = checkSubdir(*subDir); err != nil {
+			fmt.Fprintln(os.Stderr, "gproc:", err)
+			return 1
+		}
+	}
+	if *outDir != "" && *detach {
+		/* a detached job's output waits in the master; gproc attach -o takes it from there */
+		fmt.Fprintln(os.Stderr, "gproc: -o and -d do not go together; give -o to gproc attach")
+		return 1
+	}
+	var mem uint64
+	if *memoryMax != "" {
+		if mem, err = parseSize(*memoryMax); err != nil {
+			fmt.Fprintln(os.Stderr, "gproc: -mem:", err)
+			return 1
+		}
+	}
+	req := StartReq{
+		Command:         "e",
+		LocalBin:        *localbin,
+		Args:            groups[0].Args,
+		BytesToTransfer: groups[0].BytesToTransfer,
+		LibList:         libList,
+		Path:            *root,
+		Nodes:           groups[0].Nodes,
+		Cmds:            groups[0].Cmds,
+		Cwd:             cwd,
+		Subdir:          *subDir,
+		Env:             jobEnv(),
+		SetEnv:          setVars,
+		Stdin:           *stdinTo,
+		Detach:          *detach,
+		FailFast:        *failFast,
+		Staged:          *staged,
+		Tty:             *ttyMode,
+		TimeLimit:       *timeLimit,
+		KillGrace:       *killGrace,
+		Rlimits:         limits,
+		MemoryMax:       int64(mem),
+		Cpus:            *cpus,
+		PidsMax:         *pidsMax,
+	}
+	if *ttyMode {
+		if *detach {
+			fmt.Fprintln(os.Stderr, "gproc: -tty and -d do not go together")
+			return 1
+		}
+		req.Rows, req.Cols, _ = getWinsize(os.Stdin)
+	}
+	if len(groups) > 1 {
+		/* the master sends each group to its own nodes; the job as a whole is all of them */
+		req.Mpmd = groups
+		specs := []string{}
+		req.Args = nil
+		for i, g := range groups {
+			specs = append(specs, g.Nodes)
+			if i > 0 {
+				req.Args = append(req.Args, ":")
+			}
+			req.Args = append(req.Args, g.Args...)
+		}
+		req.Nodes = strings.Join(specs, ",")
+		req.Cmds = nil
+	}
+	if *dryRun {
+		return showDryRun(r, &req, excepted)
+	}
+	/* find out now, before anything runs, if there will be nowhere to put the output */
+	if *outDir != "" {
+		if err = os.MkdirAll(*outDir, 0777); err != nil {
+			fmt.Fprintln(os.Stderr, "gproc: -o:", err)
+			return 1
+		}
+	}
+
+	r.Send("startExecution", req)
+	resp := &Resp{}
+	if r.Recv("startExecution", resp) != nil {
+		log_error("Can't do start execution")
+	}
+	if resp.NumNodes == 0 {
+		fmt.Fprintln(os.Stderr, "gproc: no nodes to run on:", resp.Msg)
+		return 1
+	}
+	if strings.Contains(req.Nodes, "#") {
+		/* so that they can be used again */
+		fmt.Fprintln(os.Stderr, "gproc: running on", resp.Nodes)
+	}
+	if *detach {
+		fmt.Println(resp.JobId)
+		return 0
+	}
+	if *ttyMode {
+		/* if stdin is not a terminal, there is nothing to make raw */
+		if makeRaw(os.Stdin) == nil {
+			defer restoreTerminal()
+		}
+		go relayWinsize(r)
+	}
+	if *stdinTo != "none" {
+		go pumpStdin(r)
+	}
+	go relaySignals(r)
+	log_info("startExecution: waiting for ", resp.NumNodes)
+	code := readOutput(r)
+	log_info("startExecution: finished")
+	return code
+}
+
+/*
+ * mpmdGroups splits the command line into its groups: the first is the
+ * node list and command "gproc e" was given, and a lone ":" starts the
+ * next, as in "gproc e 1-16 ocean : 17-64 atmos". With -job, the groups
+ * come from the file instead, one "<nodes> <command> [args]" to a line.
+ */
+func mpmdGroups(nodes string, cmd []string) ([]mpmdGroup, error) {
+	if *jobFile != "" {
+		return readJobFile(*jobFile)
+	}
+	groups := []mpmdGroup{{Nodes: nodes}}
+	for i := 0; i < len(cmd); i++ {
+		g := &groups[len(groups)-1]
+		if cmd[i] != ":" {
+			g.Args = append(g.Args, cmd[i])
+			continue
+		}
+		if len(g.Args) == 0 || i+1 == len(cmd) {
+			return nil, errors.New("want <nodes> <command> on each side of a :")
+		}
+		i++
+		groups = append(groups, mpmdGroup{Nodes: cmd[i]})
+	}
+	if len(groups[len(groups)-1].Args) == 0 {
+		return nil, errors.New("want <nodes> <command> on each side of a :")
+	}
+	return groups, nil
+}
+
+/*
+ * readJobFile reads the groups of a -job file. Blank lines and lines
+ * starting with # are skipped, unless a number follows the #: #4 is a
+ * count of nodes.
+ */
+func readJobFile(name string) ([]mpmdGroup, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	groups := []mpmdGroup{}
+	for i, l := range strings.Split(string(b), "\n") {
+		f := strings.Fields(l)
+		if len(f) == 0 || f[0][0] == '#' && (len(f[0]) == 1 || f[0][1] < '0' || f[0][1] > '9') {
+			continue
+		}
+		if len(f) < 2 {
+			return nil, errors.New(fmt.Sprint(name, ":", i+1, ": want <nodes> <command> [args]"))
+		}
+		groups = append(groups, mpmdGroup{Nodes: f[0], Args: f[1:]})
+	}
+	if len(groups) == 0 {
+		return nil, errors.New(name + ": no groups")
+	}
+	return groups, nil
+}
+
+/*
+ * packGroup lists the files a group's nodes need: our cwd, the -f files,
+ * and the program and its libraries, less those the master says the
+ * nodes have already. It returns the ones left out for that reason.
+ */
+func packGroup(g *mpmdGroup, cwd string, exceptlist map[string]bool) (excepted []string) {
+	pv := newPackVisitor()
 	/* make sure our cwd ends up in the list of things to take along ...  but only take the dir*/
 	filepath.Walk(cwd+"/.", walkFunc(pv, nil))
 	if len(*filesToTakeAlong) > 0 {
@@ -61,13 +275,14 @@ func startExecution(masterAddr, fam, ioProxyPort, slaveNodes string, cmd []strin
 			filepath.Walk(rootedpath, walkFunc(pv, nil))
 		}
 	}
-	rawFiles, _ := ldd.Lddroot(cmd[0], *root, *libs)
-	log_info("LDD say rawFiles ", rawFiles, "cmds ", cmd, "root ", *root, " libs ", *libs)
+	rawFiles, _ := ldd.Lddroot(g.Args[0], *root, *libs)
+	log_info("LDD say rawFiles ", rawFiles, "cmds ", g.Args, "root ", *root, " libs ", *libs)
 
 	/* now filter out the files we will not need */
 	finishedFiles := []string{}
 	for _, s := range rawFiles {
-		if len(vitalData.Exceptlist) > 0 && vitalData.Exceptlist[s] {
+		if len(exceptlist) > 0 && exceptlist[s] {
+			excepted = append(excepted, s)
 			continue
 		}
 		finishedFiles = append(finishedFiles, s)
@@ -83,63 +298,225 @@ func startExecution(masterAddr, fam, ioProxyPort, slaveNodes string, cmd []strin
 			log_info("finishedFiles is ", finishedFiles)
 		}
 	}
-	/* build the library list given that we may have a different root */
+	g.Cmds = pv.cmds
+	g.BytesToTransfer = pv.bytesToTransfer
+	return
+}
 
-	libList := strings.SplitN(*libs, ":", -1)
-	rootedLibList := []string{}
-	for _, s := range libList {
-		log_info("startExecution: add lib ", s)
-		rootedLibList = append(rootedLibList, fmt.Sprintf("%s/%s", *root, s))
+/*
+ * readOutput prints the ioMsgs the master brings back from the nodes until
+ * the job is done, then returns the job's exit status.
+ */
+func readOutput(r *RpcClientServer) int {
+	mode := outputPlain
+	switch {
+	case *ttyMode:
+		mode = outputRaw
+	case *groupOutput:
+		mode = outputGroup
+	case *labelOutput:
+		mode = outputLabel
 	}
-	/* this test could be earlier. We leave it all the way down here so we can 
-	 * easily test the library code. Later, it can move
-	 * earlier in the code. 
-	 */
-	if !vitalData.HostReady {
-		log_info("Can not start jobs: ", vitalData.Error)
-		return
+	out := newOutputter(os.Stdout, os.Stderr, mode)
+	exits := newExitCollector()
+	var files *fileOutput
+	if *outDir != "" {
+		var err error
+		if files, err = newFileOutput(*outDir); err != nil {
+			fmt.Fprintln(os.Stderr, "gproc: -o:", err)
+			return 1
+		}
 	}
-	log_info("startExecution: libList ", libList)
-	ioProxyListenAddr := vitalData.HostAddr + ":" + ioProxyPort
-	/* The ioProxy brings back the standard i/o streams from the slaves */
-	workerChan, l, err := ioProxy(fam, ioProxyListenAddr, os.Stdout)
-	if err != nil {
-		log_error("startExecution: ioproxy: ", err)
+	for {
+		m := &ioMsg{}
+		if r.Recv("readOutput", m) != nil {
+			fmt.Fprintln(os.Stderr, "gproc: lost the master")
+			break
+		}
+		if m.Kind == ioDone {
+			break
+		}
+		if files != nil {
+			files.Write(m)
+		}
+		if files == nil || *tee {
+			out.Write(m)
+		}
+		exits.Write(m)
+	}
+	/* the terminal is ours again before we have anything to say */
+	restoreTerminal()
+	out.Flush()
+	if *showUsage {
+		exits.Usage(os.Stderr)
+	}
+	code := exits.Summary(os.Stderr)
+	if files != nil {
+		files.Close()
+		summary, err := os.Create(filepath.Join(*outDir, "summary"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gproc:", err)
+			return code
+		}
+		exits.Times(summary)
+		summary.Close()
 	}
+	return code
+}
 
-	req := StartReq{
-		Command:         "e",
-		Lfam:            l.Addr().Network(),
-		Lserver:         l.Addr().String(),
-		LocalBin:        *localbin,
-		Args:            cmd,
-		BytesToTransfer: pv.bytesToTransfer,
-		LibList:         libList,
-		Path:            *root,
-		Nodes:           slaveNodes,
-		Cmds:            pv.cmds,
-		Cwd:             cwd,
+/*
+ * showDryRun is "gproc e -n": instead of running the job, it asks the
+ * master which nodes the node list names and prints them, in rank order,
+ * then the files that would be sent to each of them; for an MPMD job,
+ * group by group.
+ */
+func showDryRun(r *RpcClientServer, req *StartReq, excepted []string) int {
+	r.Send("showDryRun", StartReq{Command: "nodes", Nodes: req.Nodes, Mpmd: req.Mpmd})
+	var l nodeList
+	if r.Recv("showDryRun", &l) != nil {
+		log_error("can not get the node list")
+	}
+	if l.Msg != "" {
+		fmt.Fprintln(os.Stderr, "gproc:", l.Msg)
+		return 1
+	}
+	if len(l.Ids) == 0 {
+		fmt.Fprintln(os.Stderr, "gproc: no nodes to run on")
+		return 1
+	}
+	fmt.Printf("%d nodes: %s\n", len(l.Ids), nodeRanges(l.Ids))
+	fmt.Printf("hosts: %s\n", nodespec.FormatHosts(l.Hosts))
+	for i, id := range l.Ids {
+		fmt.Printf("\t%-12s %-15s %s\n", id, l.Addrs[i], l.Hosts[i])
+	}
+	for i, g := range req.split() {
+		if len(req.Mpmd) > 0 {
+			fmt.Printf("\ngroup %d: %s %s\n", i+1, g.Nodes, strings.Join(g.Args, " "))
+		}
+		showFiles(g)
+	}
+	for _, s := range excepted {
+		fmt.Printf("%-5s %12s  %s (not sent: on the master's except list)\n", "-", "-", s)
 	}
+	return 0
+}
 
-	r.Send("startExecution", req)
-	resp := &Resp{}
-	if r.Recv("startExecution", resp) != nil {
-		log_error("Can't do start execution")
+/* showFiles lists the files of a request, for showDryRun. */
+func showFiles(req *StartReq) {
+	fmt.Printf("\n%-5s %12s  %s\n", "TYPE", "SIZE", "FILE")
+	files := 0
+	for _, c := range req.Cmds {
+		size := "-"
+		if fi, err := os.Lstat(c.CurrentName); err == nil && c.Ftype == 0 {
+			size = fmt.Sprint(fi.Size())
+		}
+		name := c.CurrentName + " -> " + *binRoot + c.DestName
+		switch c.Ftype {
+		case 0:
+			fmt.Printf("%-5s %12s  %s\n", "file", size, name)
+		case 1:
+			fmt.Printf("%-5s %12s  %s\n", "dir", size, name)
+		case 2:
+			fmt.Printf("%-5s %12s  %s (link to %s)\n", "link", size, name, c.SymlinkTarget)
+		default:
+			fmt.Printf("%-5s %12s  %s (not sent: not a file, directory or link)\n", "other", size, c.CurrentName)
+			continue
+		}
+		files++
 	}
-	/* numWorkers tells us how many nodes will be connecting to our ioProxy */
-	numWorkers := resp.NumNodes
-	log_info("startExecution: waiting for ", numWorkers)
-	for numWorkers > 0 {
-		<-workerChan
-		numWorkers--
-		log_info("startExecution: read from a workerchan, numworkers = ", numWorkers)
+	if req.LocalBin {
+		fmt.Println("-localbin: the nodes run", req.Args[0], "and its libraries from their own disks")
 	}
-	log_info("startExecution: finished")
+	fmt.Printf("%d files, %d bytes to send to each node\n", files, req.BytesToTransfer)
 }
 
-var (
-	BadRangeErr = errors.New("bad range format")
-)
+/*
+ * An envList is a repeatable flag: -env A=1 -env B=2, or -export A,B.
+ */
+type envList []string
+
+func (e *envList) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *envList) Set(s string) error {
+	*e = append(*e, s)
+	return nil
+}
+
+/*
+ * jobEnv is the environment the job takes from ours: all of it with
+ * -export-all, and the variables named by -export laid over that. The
+ * slaves lay it over a default environment, and the -env settings over
+ * it.
+ */
+func jobEnv() []string {
+	env := []string{}
+	if *exportAll {
+		env = os.Environ()
+	}
+	for _, names := range exportVars {
+		for _, name := range strings.Split(names, ",") {
+			if v := os.Getenv(name); v != "" || hasEnv(name) {
+				env = mergeEnv(env, []string{name + "=" + v})
+			}
+		}
+	}
+	return env
+}
+
+/* hasEnv says whether we have the variable 'name', even if it is empty. */
+func hasEnv(name string) bool {
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * pumpStdin copies our stdin to the master, and so down the tree, a chunk
+ * at a time, and tells the nodes when there is no more.
+ */
+func pumpStdin(r *RpcClientServer) {
+	buf := make([]byte, 8192)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			r.Send("pumpStdin", &ioMsg{Kind: ioStdin, Data: buf[0:n]})
+		}
+		if err != nil {
+			break
+		}
+	}
+	r.Send("pumpStdin", &ioMsg{Kind: ioStdinEOF})
+}
+
+/*
+ * relaySignals passes the signals we get on to every process of the job.
+ * The first SIGINT, SIGTERM or SIGHUP is passed on as it is; if the user
+ * is still waiting after that, the next one becomes a SIGKILL. SIGQUIT
+ * is always passed on, so Go programs can be made to dump their stacks.
+ */
+func relaySignals(r *RpcClientServer) {
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	interrupted := false
+	for s := range sigs {
+		sig := s.(syscall.Signal)
+		switch {
+		case sig == syscall.SIGQUIT:
+		case interrupted:
+			fmt.Fprintln(os.Stderr, "gproc: killing the job")
+			sig = syscall.SIGKILL
+		default:
+			fmt.Fprintf(os.Stderr, "gproc: sending %v to the job; again to kill it\n", sig)
+			interrupted = true
+		}
+		r.Send("relaySignals", &ioMsg{Kind: ioSignal, Sig: int(sig)})
+	}
+}
 
 type packVisitor struct {
 	cmds            []*cmdToExec
@@ -0,0 +1,427 @@
+/*
+ * gproc, a Go reimplementation of the LANL version of bproc and the LANL XCPU software. 
+ * 
+ * This software is released under the GNU Lesser General Public License, version 2, incorporated herein by reference. 
+ *
+ * Copyright (2010) Sandia Corporation. Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation, 
+ * the U.S. Government retains certain rights in this software.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * The output of the nodes comes back as ioMsgs, a chunk of one stream at
+ * a time, and the chunks from different nodes arrive in whatever order
+ * the tree delivers them. An outputter puts each node's streams back
+ * together and only ever writes whole lines, so stdout goes to stdout,
+ * stderr goes to stderr, and two nodes never share a line.
+ *
+ * Depending on the mode, lines go out as they are, prefixed with the node
+ * they came from, or not at all until the end, when nodes that said
+ * exactly the same thing are printed together, dshbak style.
+ */
+type outputter struct {
+	sync.Mutex
+	stdout, stderr io.Writer
+	mode           int
+	partial        map[outputKey][]byte
+}
+
+const (
+	outputPlain = iota
+	outputLabel
+	outputGroup
+	outputRaw /* a terminal's output: as it comes, lines or not */
+)
+
+/*
+ * maxLine is as long as we let a line get while we wait for the rest of
+ * it. A node that writes a progress bar, or binary, would otherwise have
+ * us hold on to all it writes; past this we write out what we have as a
+ * line of its own.
+ */
+const maxLine = 64 * 1024
+
+type outputKey struct {
+	Id   string
+	Kind int
+}
+
+func newOutputter(stdout, stderr io.Writer, mode int) *outputter {
+	return &outputter{stdout: stdout, stderr: stderr, mode: mode, partial: make(map[outputKey][]byte)}
+}
+
+func (o *outputter) writer(kind int) io.Writer {
+	if kind == ioStderr {
+		return o.stderr
+	}
+	return o.stdout
+}
+
+/* writeLines writes out complete lines, labelled with 'label' if we are labelling. */
+func (o *outputter) writeLines(kind int, label string, lines []byte) {
+	w := o.writer(kind)
+	if o.mode == outputPlain {
+		w.Write(lines)
+		return
+	}
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n') + 1
+		if i == 0 {
+			i = len(lines)
+		}
+		fmt.Fprintf(w, "%s: %s", label, lines[0:i])
+		lines = lines[i:]
+	}
+}
+
+/* Write takes an ioMsg from the ioProxy and writes out any lines it completes. */
+func (o *outputter) Write(m *ioMsg) {
+	if m.Kind != ioStdout && m.Kind != ioStderr {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.mode == outputRaw {
+		o.writer(m.Kind).Write(m.Data)
+		return
+	}
+	k := outputKey{m.Id, m.Kind}
+	buf := append(o.partial[k], m.Data...)
+	if o.mode != outputGroup {
+		if i := bytes.LastIndex(buf, []byte{'\n'}); i >= 0 {
+			o.writeLines(m.Kind, m.Id, buf[0:i+1])
+			buf = buf[i+1:]
+		}
+		if len(buf) >= maxLine {
+			o.writeLines(m.Kind, m.Id, append(buf, '\n'))
+			buf = nil
+		}
+	}
+	o.partial[k] = buf
+}
+
+/*
+ * Flush writes out whatever is left over, finishing each partial line with
+ * a newline. When grouping, this is where all the output gets written.
+ */
+func (o *outputter) Flush() {
+	o.Lock()
+	defer o.Unlock()
+	for k, buf := range o.partial {
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			o.partial[k] = append(buf, '\n')
+		}
+	}
+	if o.mode == outputGroup {
+		o.writeGroups(ioStdout)
+		o.writeGroups(ioStderr)
+	} else {
+		for k, buf := range o.partial {
+			o.writeLines(k.Kind, k.Id, buf)
+		}
+	}
+	o.partial = make(map[outputKey][]byte)
+}
+
+/* writeGroups writes out one stream of each node, with identical output written once for all of its nodes. */
+func (o *outputter) writeGroups(kind int) {
+	same := make(map[string]nodeIds)
+	for k, buf := range o.partial {
+		if k.Kind == kind && len(buf) > 0 {
+			same[string(buf)] = append(same[string(buf)], k.Id)
+		}
+	}
+	groups := make([]nodeIds, 0, len(same))
+	outputs := make(map[string]string)
+	for out, ids := range same {
+		sort.Sort(ids)
+		groups = append(groups, ids)
+		outputs[ids[0]] = out
+	}
+	sort.Sort(byFirstNode(groups))
+	for _, ids := range groups {
+		o.writeLines(kind, nodeRanges(ids), []byte(outputs[ids[0]]))
+	}
+}
+
+type byFirstNode []nodeIds
+
+func (g byFirstNode) Len() int           { return len(g) }
+func (g byFirstNode) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g byFirstNode) Less(i, j int) bool { return nodeIds{g[i][0], g[j][0]}.Less(0, 1) }
+
+/*
+ * nodeRanges writes a sorted list of node ids in node specification
+ * syntax: runs of consecutive nodes become ranges, so 1 2 3 3/1 3/2 5 comes
+ * out as 1-3,3/1-2,5.
+ */
+func nodeRanges(ids nodeIds) string {
+	var ranges []string
+	for i := 0; i < len(ids); {
+		parent, first := splitId(ids[i])
+		beg, err := strconv.Atoi(first)
+		j := i + 1
+		if err == nil {
+			for ; j < len(ids); j++ {
+				p, n := splitId(ids[j])
+				next, err := strconv.Atoi(n)
+				if p != parent || err != nil || next != beg+j-i {
+					break
+				}
+			}
+		}
+		r := first
+		if j-i > 1 {
+			_, last := splitId(ids[j-1])
+			r += "-" + last
+		}
+		ranges = append(ranges, fullId(parent, r))
+		i = j
+	}
+	return strings.Join(ranges, ",")
+}
+
+/* splitId splits a node id into its parent's id and its own. */
+func splitId(nodeId string) (parentId, id string) {
+	i := strings.LastIndex(nodeId, "/")
+	if i < 0 {
+		return "", nodeId
+	}
+	return nodeId[0:i], nodeId[i+1:]
+}
+
+/*
+ * A fileOutput writes each node's output to files of its own in a
+ * directory instead of to the terminal: node 3's stdout to 3.out and its
+ * stderr to 3.err, node 3/5's to 3/5.out and 3/5.err. Every node that
+ * starts gets both files, even if it says nothing.
+ */
+type fileOutput struct {
+	sync.Mutex
+	dir   string
+	files map[outputKey]*os.File
+}
+
+func newFileOutput(dir string) (*fileOutput, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &fileOutput{dir: dir, files: make(map[outputKey]*os.File)}, nil
+}
+
+/* file returns the file for one stream of a node, creating it the first time; nil if it could not be. */
+func (o *fileOutput) file(k outputKey) *os.File {
+	if f, ok := o.files[k]; ok {
+		return f
+	}
+	name := filepath.Join(o.dir, k.Id+".out")
+	if k.Kind == ioStderr {
+		name = filepath.Join(o.dir, k.Id+".err")
+	}
+	os.MkdirAll(filepath.Dir(name), 0777)
+	f, err := os.Create(name)
+	if err != nil {
+		/* say so once, not for every write */
+		fmt.Fprintln(os.Stderr, "gproc:", err)
+		f = nil
+	}
+	o.files[k] = f
+	return f
+}
+
+func (o *fileOutput) Write(m *ioMsg) {
+	o.Lock()
+	defer o.Unlock()
+	switch m.Kind {
+	case ioStarted:
+		o.file(outputKey{m.Id, ioStdout})
+		o.file(outputKey{m.Id, ioStderr})
+	case ioStdout, ioStderr:
+		if f := o.file(outputKey{m.Id, m.Kind}); f != nil {
+			f.Write(m.Data)
+		}
+	}
+}
+
+/* Close closes all the files. */
+func (o *fileOutput) Close() {
+	o.Lock()
+	defer o.Unlock()
+	for _, f := range o.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+/*
+ * An exitCollector keeps track of the nodes that have started and how
+ * they finished, so that "gproc e" can tell the user which ones failed
+ * and exit with a status scripts can trust.
+ */
+type exitCollector struct {
+	sync.Mutex
+	started  map[string]bool
+	exited   map[string]*exitStatus
+	failedBy string /* the node that brought down a -fail-fast job */
+}
+
+func newExitCollector() *exitCollector {
+	return &exitCollector{started: make(map[string]bool), exited: make(map[string]*exitStatus)}
+}
+
+func (x *exitCollector) Write(m *ioMsg) {
+	x.Lock()
+	defer x.Unlock()
+	switch m.Kind {
+	case ioStarted:
+		x.started[m.Id] = true
+	case ioExit:
+		x.exited[m.Id] = m.Status
+	case ioFailFast:
+		x.failedBy = m.Id
+	}
+}
+
+/*
+ * Summary prints the nodes that failed, if any, and returns the exit
+ * status for "gproc e": the largest of the failed nodes' exit codes,
+ * or 0 if they all succeeded. If a -fail-fast job was torn down, the
+ * rest were killed for the sake of one node, and it is that node's.
+ */
+func (x *exitCollector) Summary(w io.Writer) (code int) {
+	x.Lock()
+	defer x.Unlock()
+	failed, timedOut := nodeIds{}, nodeIds{}
+	for n, s := range x.exited {
+		if s.Failed() {
+			failed = append(failed, n)
+		}
+		if s.TimedOut {
+			timedOut = append(timedOut, n)
+		}
+	}
+	for n := range x.started {
+		if _, ok := x.exited[n]; !ok {
+			x.exited[n] = &exitStatus{Lost: true}
+			failed = append(failed, n)
+		}
+	}
+	if len(failed) == 0 {
+		return 0
+	}
+	sort.Sort(failed)
+	fmt.Fprintf(w, "gproc: %d of %d nodes failed:\n", len(failed), len(x.exited))
+	for _, n := range failed {
+		s := x.exited[n]
+		fmt.Fprintf(w, "\t%s: %v\n", n, s)
+		if s.ExitCode() > code {
+			code = s.ExitCode()
+		}
+	}
+	if len(timedOut) > 0 {
+		sort.Sort(timedOut)
+		fmt.Fprintf(w, "gproc: %d nodes timed out: %s\n", len(timedOut), nodeRanges(timedOut))
+	}
+	if s, ok := x.exited[x.failedBy]; ok {
+		fmt.Fprintf(w, "gproc: node %s failed (%v), so the job was torn down\n", x.failedBy, s)
+		code = s.ExitCode()
+	}
+	return
+}
+
+/* Usage lists what each node that has finished used. */
+func (x *exitCollector) Usage(w io.Writer) {
+	x.Lock()
+	defer x.Unlock()
+	ids := nodeIds{}
+	for n := range x.exited {
+		ids = append(ids, n)
+	}
+	sort.Sort(ids)
+	for _, n := range ids {
+		fmt.Fprintf(w, "%-12s %s\n", n, x.exited[n].Usage())
+	}
+}
+
+/*
+ * Times writes a line for each node that started, with its exit code,
+ * how it finished, and when it started and finished by its own clock,
+ * then a line for the job as a whole. Call it after Summary, which
+ * notes the nodes that were lost.
+ */
+func (x *exitCollector) Times(w io.Writer) {
+	x.Lock()
+	defer x.Unlock()
+	const layout = "2006-01-02T15:04:05.000"
+	fmt.Fprintf(w, "%-12s %-4s %-23s %-23s %-12s %s\n", "node", "exit", "start", "end", "elapsed", "status")
+	ids := nodeIds{}
+	for n := range x.exited {
+		ids = append(ids, n)
+	}
+	sort.Sort(ids)
+	var first, last time.Time
+	failed := 0
+	for _, n := range ids {
+		s := x.exited[n]
+		start, end, elapsed := "-", "-", "-"
+		if !s.Start.IsZero() {
+			start, end = s.Start.Format(layout), s.End.Format(layout)
+			elapsed = s.End.Sub(s.Start).String()
+			if first.IsZero() || s.Start.Before(first) {
+				first = s.Start
+			}
+			if s.End.After(last) {
+				last = s.End
+			}
+		}
+		if s.Failed() {
+			failed++
+		}
+		fmt.Fprintf(w, "%-12s %-4d %-23s %-23s %-12s %v\n", n, s.ExitCode(), start, end, elapsed, s)
+	}
+	elapsed := "-"
+	if !first.IsZero() {
+		elapsed = last.Sub(first).String()
+	}
+	fmt.Fprintf(w, "job: %d nodes, %d failed, %s from the first start to the last finish\n", len(ids), failed, elapsed)
+}
+
+/*
+ * nodeIds sorts node ids the way people expect: 3/5 comes before 3/10,
+ * which comes before 4.
+ */
+type nodeIds []string
+
+func (n nodeIds) Len() int      { return len(n) }
+func (n nodeIds) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n nodeIds) Less(i, j int) bool {
+	a := strings.Split(n[i], "/")
+	b := strings.Split(n[j], "/")
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] == b[k] {
+			continue
+		}
+		ai, aerr := strconv.Atoi(a[k])
+		bi, berr := strconv.Atoi(b[k])
+		if aerr == nil && berr == nil {
+			return ai < bi
+		}
+		return a[k] < b[k]
+	}
+	return len(a) < len(b)
+}
@@ -10,13 +10,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -56,7 +61,13 @@ func runSlave() {
 /* note that we're going to be able to merge master and slave fairly soon, now that they do almost the same things. */
 func startSlave() {
 	/* slight difference from master: we're ready when we start, since we run things */
-	vitalData := &vitalData{HostReady: true, Id: *myId}
+	vitalData := &vitalData{HostReady: true, Id: *myId, Key: newKey()}
+	vitalData.Hostname = nodeHostname()
+	labels, err := nodeLabels()
+	if err != nil {
+		log_error("startSlave: labels: ", err)
+	}
+	vitalData.Labels = labels
 	masterAddr := *parent + ":" + *cmdPort
 	log_info("dialing masterAddr ", masterAddr)
 	master, err := Dial(*defaultFam, "", masterAddr)
@@ -86,6 +97,7 @@ func startSlave() {
 	r := NewRpcClientServer(master, *binRoot)
 	initSlave(r, vitalData)
 	go registerSlaves()
+	go reportSlaves(r)
 	/* wow. This used to be much smaller and needs to be redone. */
 	go func() {
 		for {
@@ -96,6 +108,11 @@ func startSlave() {
 				return
 			}
 			log_info("Received connection from: ", c.RemoteAddr())
+			if !checkKey(c, vitalData.Key, 10*time.Second) {
+				log_info("startSlave: ", c.RemoteAddr(), " is not our parent; hanging up")
+				c.Close()
+				continue
+			}
 
 			// start a new process, give it 'c' as stdin.
 			connFile, _ := c.File()                              // the new process will read a StartReq from connFile
@@ -109,7 +126,12 @@ func startSlave() {
 				fmt.Sprintf("-debug=%v", *Extra_debug),
 				fmt.Sprintf("-p=%v", *DoPrivateMount),
 				fmt.Sprintf("-binRoot=%v", *binRoot),
-				fmt.Sprintf("-parent=%v", *parent),
+				fmt.Sprintf("-myParent=%v", *parent),
+				fmt.Sprintf("-connectwait=%v", *connectWait),
+				"-myId=" + id,
+				"-hostname=" + *hostname,
+				"-gprocBin=" + helperPath(),
+				"-cgroup=" + *cgroupParent,
 				"-prefix=" + id,
 				"R", // "R" = run a program
 			}
@@ -122,14 +144,13 @@ func startSlave() {
 				passrpc := &RpcClientServer{E: gob.NewEncoder(writep), D: gob.NewDecoder(writep)}
 				returnrpc := &RpcClientServer{E: gob.NewEncoder(readp2), D: gob.NewDecoder(readp2)}
 
-				var ne nodeExecList
+				var spec string
 				// This is the list of nodes the child got in its request
-				if returnrpc.Recv("startSlave getting nodes ", &ne) != nil {
+				if returnrpc.Recv("startSlave getting nodes ", &spec) != nil {
 					return
 				}
 				// The child doesn't have the slaves populated, so we have to do it
-				ne.Nodes = slaves.ServIntersect(ne.Nodes)
-				passrpc.Send("startSlave sending nodes ", ne)
+				passrpc.Send("startSlave sending nodes ", slaves.Servers())
 
 				w, _ := p.Wait() // Wait until the child process is finished. We need to do things sorta synchronously
 				log_info("startSlave: process returned ", w.String())
@@ -168,8 +189,8 @@ func initSlave(r *RpcClientServer, v *vitalData) {
  *
  * There are 3 RpcClientServer arguments, because of the way things work.
  * 'r' is connected to this node's parent/master so we can read the StartReq
- * 'inforpc' is connected to the original slave process, which knows our slaves and can send us a nodeExecList
- * 'returnrpc' is used to ask the original slave process for a nodeExecList after we get the StartReq
+ * 'inforpc' is connected to the original slave process, which knows our slaves and can send us the servers of the sub-nodes we are to pass the job on to
+ * 'returnrpc' is used to tell the original slave process which nodes the job is for after we get the StartReq
  */
 func slaveProc(r *RpcClientServer, inforpc *RpcClientServer, returnrpc *RpcClientServer) {
 	// Make sure the root (default /tmp/xproc) exists
@@ -179,7 +200,7 @@ func slaveProc(r *RpcClientServer, inforpc *RpcClientServer, returnrpc *RpcClien
 		doPrivateMount(*binRoot)
 	}
 
-	done := make(chan int, 0) // this is how we'll know the command is done
+	done := make(chan *exitStatus, 0) // this is how we'll know the command is done
 
 	// Receive a StartReq from the master/parent
 	req := &StartReq{}
@@ -189,96 +210,729 @@ func slaveProc(r *RpcClientServer, inforpc *RpcClientServer, returnrpc *RpcClien
 	log_info("slaveProc: req ", *req)
 
 	// Establish a connection to the IO proxy
-	n, c, err := fileTcpDial(req.Lserver)
+	c, err := Dial(*defaultFam, "", req.Lserver)
 	if err != nil {
 		log_info("tcpDial: ", err)
 		return
 	}
+	up := NewRpcClientServer(c, *binRoot)
+	id = *myId
+	nodeId := fullId(req.ParentId, id)
+	/* a staged node has not started anything until the go, below */
+	if req.Staged {
+		up.Send("slaveProc", &ioMsg{Kind: ioStaged, Id: nodeId})
+	} else {
+		up.Send("slaveProc", &ioMsg{Kind: ioStarted, Id: nodeId})
+	}
 
-	// Run the program
-	go runLocal(req, n, done)
+	/* stdin comes down the ioProxy connection. If it is meant for
+	 * someone else, our program gets /dev/null and we just pass it on.
+	 */
+	wantsStdin := req.Stdin == "" || req.Stdin == "all" || req.Stdin == nodeId
+	/* a -tty job's terminal is for the node it names, which the master has given our stdin */
+	wantsTty := req.Tty && req.Stdin == nodeId
+	var stdin, stdinw, stdout, stderr, tty *os.File
+	outDone := make(chan int, 2)
+	if wantsTty {
+		/* the program gets a terminal instead, which is its stdin, stdout
+		 * and stderr in one; everything it writes there goes up as stdout
+		 */
+		if tty, stdin, err = openPty(); err != nil {
+			log_info("slaveProc: tty: ", err)
+			up.Send("slaveProc", &ioMsg{Kind: ioExit, Id: nodeId, Status: &exitStatus{Err: "tty: " + err.Error()}})
+			return
+		}
+		stdin.Chown(req.Uid, -1)
+		if req.Rows > 0 {
+			setWinsize(tty, req.Rows, req.Cols)
+		}
+		stdout, stderr = stdin, stdin
+		if wantsStdin {
+			/* a copy, so that the end of our stdin does not cut off its output */
+			fd, err := syscall.Dup(int(tty.Fd()))
+			if err != nil {
+				log_info("slaveProc: tty: ", err)
+				return
+			}
+			stdinw = os.NewFile(uintptr(fd), tty.Name())
+		}
+		go sendOutput(up, nodeId, ioStdout, tty, outDone)
+		outDone <- 0
+	} else {
+		if wantsStdin {
+			stdin, stdinw, err = os.Pipe()
+		} else {
+			stdin, err = os.Open(os.DevNull)
+		}
+		if err != nil {
+			log_info("slaveProc: stdin: ", err)
+			return
+		}
+		/* stdout and stderr go up the ioProxy connection, tagged with who we are */
+		var stdoutr, stderrr *os.File
+		if stdoutr, stdout, err = os.Pipe(); err != nil {
+			log_info("slaveProc: stdout: ", err)
+			return
+		}
+		if stderrr, stderr, err = os.Pipe(); err != nil {
+			log_info("slaveProc: stderr: ", err)
+			return
+		}
+		go sendOutput(up, nodeId, ioStdout, stdoutr, outDone)
+		go sendOutput(up, nodeId, ioStderr, stderrr, outDone)
+	}
+
+	// Run the program, with its own copy of the request, since we change ours as we pass it on
+	local := *req
+	local.Tty = wantsTty
+	expandRequest(&local, nodeId)
+	local.Env = mergeEnv(mergeEnv(req.Env, local.SetEnv), gprocEnv(req, nodeId))
+	lp := &localProc{tty: tty}
+	/* a staged job waits for the master's go; see below */
+	var g *gate
+	var st *stage
+	if req.Staged {
+		g = newGate()
+		st = newStage()
+	} else {
+		go runLocal(&local, lp, stdin, stdout, stderr, done)
+	}
 
 	/* the child may end before we even get here, but since we still own this name 
 	 * space, the files are still there. Now we set up an ioProxy and copy the StartReq
 	 * and files to any children we may have.
 	 */
-	var nodesCopy string
 	var l Listener
 	var workerChan chan int
-	var numWorkers int
-	numWorkers = 0
-	nodesCopy = req.Nodes
-	slaveNodes, err := parseNodeList(nodesCopy)
-	if err != nil {
+	var down *downstream
+	returnrpc.Send("send slaveNodes ", req.Nodes)
+	var servers map[string]server
+	if inforpc.Recv("recv availableSlaves", &servers) != nil {
 		return
 	}
-	returnrpc.Send("send slaveNodes ", slaveNodes[0])
-	var availableSlaves nodeExecList
-	if inforpc.Recv("recv availableSlaves", &availableSlaves) != nil {
-		return
+	subNodes, err := delegate(req.Nodes, servers)
+	if err != nil {
+		log_info("slaveProc: ", err)
 	}
-	log_info("receiveCmds: sendReq.Nodes: ", req.Nodes, " expands to ", slaveNodes)
+	log_info("receiveCmds: sendReq.Nodes: ", req.Nodes, " goes to ", subNodes)
 
-	if len(availableSlaves.Nodes) > 0 {
-		workerChan, l, err = ioProxy(*defaultFam, *myAddress+":0", c)
+	if len(subNodes) > 0 {
+		/* our sub-nodes' output is already tagged; just pass it up. We say when our subtree is ready. */
+		workerChan, l, down, err = ioProxy(*defaultFam, *myAddress+":0", func(m *ioMsg) {
+			if st != nil && st.Update(m) {
+				return
+			}
+			up.Send("slaveProc ioProxy", m)
+		})
 		if err != nil {
 			log_error("slave: ioproxy: ", err)
 		}
 		log_info("netwaiter locl.Ip() ", *myAddress, " listener at ", l.Addr().String())
 		req.Lfam = l.Addr().Network()
 		req.Lserver = l.Addr().String()
-
-		for _, _ = range availableSlaves.Nodes {
-			numWorkers += 1
+	}
+	req.ParentId = nodeId
+	sent := []string{}
+	for _, n := range subNodes {
+		fid := fullId(nodeId, n.Id)
+		if sendCommandsToANodeSet(req, n.Subnodes, *binRoot, []server{n.Server}, func(err error) { down.Sent(fid, err) }) == 0 {
+			continue
+		}
+		sent = append(sent, fid)
+		if st != nil {
+			st.Expect(fid)
+		}
+	}
+	numWorkers := len(sent)
+	log_info("Sent to ", numWorkers, " nodes")
+	if down != nil {
+		down.Expect(sent)
+	}
+	var feeder *stdinFeeder
+	if stdinw != nil {
+		feeder = newStdinFeeder(stdinw)
+	}
+	go relayDown(up, nodeId, lp, feeder, down, g)
+	if g != nil {
+		/* our files are here, and those of everyone below us are there */
+		st.Wait()
+		up.Send("slaveProc", &ioMsg{Kind: ioReady, Id: nodeId})
+		if sig := g.Wait(); sig != 0 {
+			log_info("slaveProc: signal ", sig, " before the go, not starting")
+			stdin.Close()
+			stdout.Close()
+			stderr.Close()
+			go func() { done <- &exitStatus{Signal: int(sig)} }()
+		} else {
+			up.Send("slaveProc", &ioMsg{Kind: ioStarted, Id: nodeId})
+			go runLocal(&local, lp, stdin, stdout, stderr, done)
 		}
 	}
-	nnodes := sendCommandsToANodeSet(req, slaveNodes[0].Subnodes, *binRoot, availableSlaves.Nodes)
-	log_info("Sent to ", nnodes, " nodes")
 	// Wait for all the children to finish execution
 	for numWorkers > 0 {
 		worker := <-workerChan
 		log_info(worker, " returned, ", numWorkers, " workers left")
 		numWorkers--
 	}
-	<-done // wait until our own instance has finished executing
+	status := <-done // wait until our own instance has finished executing
+	<-outDone
+	<-outDone
+	up.Send("slaveProc", &ioMsg{Kind: ioExit, Id: nodeId, Status: status})
 	c.Close()
-	n.Close()
 	log_info("Exiting slaveProc")
 }
 
+/*
+ * The environment a program starts with, before the one it was sent
+ * with is laid over it.
+ */
+var defaultEnv = []string{
+	"PATH=/usr/local/bin:/usr/bin:/bin:/usr/local/sbin:/usr/sbin:/sbin",
+	"HOME=/",
+	"SHELL=/bin/sh",
+	"LANG=C",
+}
+
+/*
+ * mergeEnv lays the NAME=VALUE settings in 'over' over those in 'env':
+ * a name in both gets the value from 'over', in the place it had in 'env'.
+ */
+func mergeEnv(env, over []string) []string {
+	merged := []string{}
+	where := make(map[string]int)
+	for _, l := range [][]string{env, over} {
+		for _, e := range l {
+			name := strings.SplitN(e, "=", 2)[0]
+			if i, ok := where[name]; ok {
+				merged[i] = e
+				continue
+			}
+			where[name] = len(merged)
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+/*
+ * gprocEnv tells the program who it is in the job: the job id, its rank
+ * and node id, how many nodes there are, its parent's node id (empty
+ * under the master), and the addresses of all the nodes, in rank order.
+ * A node the master did not know about when the job started, because it
+ * had only just registered, gets no rank.
+ */
+func gprocEnv(req *StartReq, nodeId string) []string {
+	env := []string{
+		fmt.Sprint("GPROC_JOBID=", req.JobId),
+		"GPROC_NODEID=" + nodeId,
+		"GPROC_PARENT=" + req.ParentId,
+		fmt.Sprint("GPROC_NNODES=", len(req.Ranks)),
+		"GPROC_PEERS=" + strings.Join(req.RankAddrs, ","),
+	}
+	for rank, n := range req.Ranks {
+		if n == nodeId {
+			env = append(env, fmt.Sprint("GPROC_RANK=", rank))
+		}
+	}
+	return env
+}
+
+/*
+ * expandRequest fills in the placeholders in the arguments, -env
+ * settings and -cwd of our copy of the request, so that each node can be
+ * given its own input file, port or directory. The program name is left
+ * alone: that is the file that was sent. So is the working directory,
+ * which is where the files were sent, and the variables passed on with
+ * -export, which are not ours to change.
+ */
+func expandRequest(req *StartReq, nodeId string) {
+	vars := templateVars(req, nodeId)
+	args := []string{req.Args[0]}
+	for _, a := range req.Args[1:] {
+		args = append(args, expandTemplate(a, vars))
+	}
+	req.Args = args
+	env := []string{}
+	for _, e := range req.SetEnv {
+		env = append(env, expandTemplate(e, vars))
+	}
+	req.SetEnv = env
+	req.Subdir = expandTemplate(req.Subdir, vars)
+}
+
+/* checkSubdir says whether a -cwd stays under the working directory: it may not start with / or have .. in it. */
+func checkSubdir(dir string) error {
+	if strings.HasPrefix(dir, "/") {
+		return errors.New("-cwd " + dir + ": not under the working directory")
+	}
+	for _, e := range strings.Split(dir, "/") {
+		if e == ".." {
+			return errors.New("-cwd " + dir + ": has .. in it")
+		}
+	}
+	return nil
+}
+
+/*
+ * makeSubdir makes the -cwd directory 'sub' under 'dir', a directory at
+ * a time, owned by the job's user, and returns its name. We are root, and
+ * the user may have put links there, so it goes through none.
+ */
+func makeSubdir(dir, sub string, uid, gid int) (string, error) {
+	if err := checkSubdir(sub); err != nil {
+		return "", err
+	}
+	for _, e := range strings.Split(sub, "/") {
+		if e == "" || e == "." {
+			continue
+		}
+		dir += "/" + e
+		fi, err := os.Lstat(dir)
+		switch {
+		case os.IsNotExist(err):
+			if err = os.Mkdir(dir, 0755); err == nil {
+				err = os.Lchown(dir, uid, gid)
+			}
+		case err != nil:
+		case fi.Mode()&os.ModeSymlink != 0:
+			err = errors.New("-cwd: " + dir + " is a link")
+		case !fi.IsDir():
+			err = errors.New("-cwd: " + dir + " is not a directory")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+/* nodeHostname is the name we go by in node lists: -hostname, or our host name. */
+func nodeHostname() string {
+	if *hostname != "" {
+		return *hostname
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+/*
+ * templateVars is what the placeholders stand for on this node: %r the
+ * rank (empty if we have none), %n the node id, %N the number of nodes,
+ * %h the hostname and %j the job id.
+ */
+func templateVars(req *StartReq, nodeId string) map[byte]string {
+	host := nodeHostname()
+	vars := map[byte]string{
+		'r': "",
+		'n': nodeId,
+		'N': strconv.Itoa(len(req.Ranks)),
+		'h': host,
+		'j': strconv.Itoa(req.JobId),
+		'%': "%",
+	}
+	for rank, n := range req.Ranks {
+		if n == nodeId {
+			vars['r'] = strconv.Itoa(rank)
+		}
+	}
+	return vars
+}
+
+/* expandTemplate replaces each placeholder in s; a % followed by anything else is left as it is. */
+func expandTemplate(s string, vars map[byte]string) string {
+	if strings.IndexRune(s, '%') < 0 {
+		return s
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+1 < len(s) {
+			if v, ok := vars[s[i+1]]; ok {
+				b.WriteString(v)
+				i++
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+/*
+ * sendOutput reads one of our program's output streams until it is
+ * closed, and sends what it reads up to the ioProxy above us.
+ */
+func sendOutput(up *RpcClientServer, nodeId string, kind int, f *os.File, outDone chan int) {
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			up.Send("sendOutput", &ioMsg{Kind: kind, Id: nodeId, Data: buf[0:n]})
+		}
+		if err != nil {
+			break
+		}
+	}
+	f.Close()
+	outDone <- 1
+}
+
+/*
+ * A gate holds a staged job's program back until the master says go.
+ * If a signal for the program comes first, the program never runs, and
+ * the signal is what it is reported to have died of.
+ */
+type gate struct {
+	sync.Mutex
+	c    chan bool
+	sig  syscall.Signal
+	open bool
+}
+
+func newGate() *gate {
+	return &gate{c: make(chan bool)}
+}
+
+/* Open lets Wait return sig, 0 for go. Only the first call counts. */
+func (g *gate) Open(sig syscall.Signal) {
+	g.Lock()
+	defer g.Unlock()
+	if g.open {
+		return
+	}
+	g.open = true
+	g.sig = sig
+	close(g.c)
+}
+
+func (g *gate) Wait() syscall.Signal {
+	<-g.c
+	g.Lock()
+	defer g.Unlock()
+	return g.sig
+}
+
+/*
+ * A localProc is the program this node runs for the job. Signals for it
+ * go to its whole process group, so whatever it has started gets them
+ * too. A signal that arrives before the program has started is held
+ * until it has; one that arrives after it has exited is dropped, since
+ * its process group id may belong to someone else by then.
+ */
+type localProc struct {
+	sync.Mutex
+	tty      *os.File /* the master side of its terminal, if it has one */
+	p        *os.Process
+	pending  []syscall.Signal
+	exited   bool
+	timedOut bool
+}
+
+func (lp *localProc) Signal(sig syscall.Signal) {
+	lp.Lock()
+	defer lp.Unlock()
+	lp.signal(sig)
+}
+
+func (lp *localProc) signal(sig syscall.Signal) {
+	switch {
+	case lp.exited:
+	case lp.p == nil:
+		lp.pending = append(lp.pending, sig)
+	default:
+		log_info("localProc: signal ", sig, " to ", lp.p.Pid)
+		syscall.Kill(-lp.p.Pid, sig)
+	}
+}
+
+/*
+ * timeLimit arranges for the program to get SIGTERM once it has run for
+ * 'limit', and SIGKILL if it is still there 'grace' after that.
+ */
+func (lp *localProc) timeLimit(limit, grace time.Duration) {
+	time.AfterFunc(limit, func() {
+		lp.Lock()
+		defer lp.Unlock()
+		if lp.exited {
+			return
+		}
+		log_info("localProc: time limit of ", limit, " is up")
+		lp.timedOut = true
+		lp.signal(syscall.SIGTERM)
+		time.AfterFunc(grace, func() {
+			lp.Signal(syscall.SIGKILL)
+		})
+	})
+}
+
+/* wait waits for the program to exit and says whether it ran out of time. */
+func (lp *localProc) wait() (*os.ProcessState, bool, error) {
+	w, err := lp.p.Wait()
+	lp.Lock()
+	defer lp.Unlock()
+	lp.exited = true
+	return w, lp.timedOut, err
+}
+
+func (lp *localProc) started(p *os.Process) {
+	lp.Lock()
+	lp.p = p
+	pending := lp.pending
+	lp.pending = nil
+	lp.Unlock()
+	for _, sig := range pending {
+		lp.Signal(sig)
+	}
+}
+
+/*
+ * A stdinFeeder writes stdin to our program without ever holding up
+ * relayDown: a program that is not reading its stdin must not keep
+ * signals from getting through, nor stdin from getting to other nodes.
+ * So stdin queues up here until the program gets around to it.
+ */
+type stdinFeeder struct {
+	sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+}
+
+func newStdinFeeder(w *os.File) *stdinFeeder {
+	f := &stdinFeeder{}
+	f.cond = sync.NewCond(&f.Mutex)
+	go f.feed(w)
+	return f
+}
+
+func (f *stdinFeeder) Write(b []byte) {
+	f.Lock()
+	f.queue = append(f.queue, b)
+	f.cond.Signal()
+	f.Unlock()
+}
+
+func (f *stdinFeeder) Close() {
+	f.Lock()
+	f.closed = true
+	f.cond.Signal()
+	f.Unlock()
+}
+
+func (f *stdinFeeder) feed(w *os.File) {
+	broken := false
+	for {
+		f.Lock()
+		for len(f.queue) == 0 && !f.closed {
+			f.cond.Wait()
+		}
+		if len(f.queue) == 0 {
+			f.Unlock()
+			break
+		}
+		b := f.queue[0]
+		f.queue = f.queue[1:]
+		f.Unlock()
+		/* the program may well have exited or closed its stdin; then we just throw stdin away */
+		if !broken {
+			_, err := w.Write(b)
+			broken = err != nil
+		}
+	}
+	w.Close()
+}
+
+/* isFor says whether a message coming down is for the node with full id nodeId. */
+func isFor(m *ioMsg, nodeId string) bool {
+	if len(m.To) == 0 {
+		return true
+	}
+	for _, n := range m.To {
+		if n == nodeId {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * relayDown reads what comes down from the ioProxy above us. Stdin
+ * goes to our own program, if it wants it, signals go to it regardless,
+ * and everything goes on to our sub-nodes.
+ * 'stdin' is nil if the program does not get our stdin; 'down' is nil
+ * if we have no sub-nodes; 'g' is nil unless the job is staged, in which
+ * case the master's go, or a signal, opens it.
+ */
+func relayDown(up *RpcClientServer, nodeId string, lp *localProc, stdin *stdinFeeder, down *downstream, g *gate) {
+	for {
+		var m ioMsg
+		if up.Recv("relayDown", &m) != nil {
+			break
+		}
+		switch m.Kind {
+		case ioGo:
+			if g != nil {
+				g.Open(0)
+			}
+		case ioWinsize:
+			if lp.tty != nil && isFor(&m, nodeId) {
+				setWinsize(lp.tty, m.Rows, m.Cols)
+			}
+		case ioSignal:
+			if isFor(&m, nodeId) {
+				lp.Signal(syscall.Signal(m.Sig))
+				if g != nil {
+					g.Open(syscall.Signal(m.Sig))
+				}
+			}
+		case ioStdin:
+			if stdin != nil {
+				stdin.Write(m.Data)
+			}
+		case ioStdinEOF:
+			if stdin != nil {
+				stdin.Close()
+				stdin = nil
+			}
+		}
+		if down != nil {
+			down.Send(&m)
+		}
+	}
+	if stdin != nil {
+		stdin.Close()
+	}
+	/* nobody is left to say go */
+	if g != nil {
+		g.Open(syscall.SIGHUP)
+	}
+}
+
 /*
  * This function is used to run a program which has been specified in
  * a StartReq and sent to the slave.
  *
- * 'n' points to a connection to the ioProxy directly "above" us.
+ * 'stdin', 'stdout' and 'stderr' are the program's; we close our copies
+ * once it has started. The program gets a process group of its own so
+ * that 'lp' can signal everything it starts.
  */
-func runLocal(req *StartReq, n *os.File, done chan int) {
-	log_info("runLocal: dialed %v", n)
-	f := []*os.File{n, n, n} // set up stdin/stdout/stderr for the program
+func runLocal(req *StartReq, lp *localProc, stdin, stdout, stderr *os.File, done chan *exitStatus) {
+	f := []*os.File{stdin, stdout, stderr} // set up stdin/stdout/stderr for the program
 	var pathbase = *binRoot
 	execpath := pathbase + req.Path + req.Args[0]
 	if req.LocalBin {
 		execpath = req.Args[0]
 	}
 	log_info("run: execpath: ", execpath)
-	Env := req.Env
-	/* now build the LD_LIBRARY_PATH variable */
+	Env := mergeEnv(defaultEnv, req.Env)
+	/* now build the LD_LIBRARY_PATH variable; the libraries we brought come first */
 	ldLibPath := "LD_LIBRARY_PATH="
 	for _, s := range req.LibList {
 		ldLibPath = ldLibPath + *binRoot + req.Path + s + ":"
 	}
-	Env = append(Env, ldLibPath)
+	for _, e := range Env {
+		if strings.HasPrefix(e, "LD_LIBRARY_PATH=") {
+			ldLibPath += e[len("LD_LIBRARY_PATH="):]
+		}
+	}
+	Env = mergeEnv(Env, []string{ldLibPath})
 	log_info("run: Env ", Env)
 	procattr := os.ProcAttr{Env: Env, Dir: pathbase + "/" + req.Cwd,
-		Files: f}
-	log_info("run: dir: ", pathbase+"/"+req.Cwd)
-	p, err := os.StartProcess(execpath, req.Args, &procattr)
+		Files: f, Sys: &syscall.SysProcAttr{Setpgid: true}}
+	if req.Tty {
+		/* a session of its own, with the terminal on its stdin as the controlling one */
+		procattr.Sys = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	}
+	var cg *cgroup
+	var envw *os.File
+	var err error
+	if req.Subdir != "" {
+		procattr.Dir, err = makeSubdir(procattr.Dir, req.Subdir, req.Uid, req.Gid)
+	}
+	log_info("run: dir: ", procattr.Dir)
+	if err == nil && (*cgroupParent != "" || req.wantsCgroup()) {
+		cg, err = newCgroup(*cgroupParent, fmt.Sprint("job", req.JobId, "-", os.Getpid()), req)
+	}
+	argv := req.Args
+	runAs := req.Uid != os.Getuid() || req.Gid != os.Getgid()
+	if len(req.Rlimits) > 0 || cg != nil || runAs {
+		/* the limits and the identity are for the program, not us, so a helper sets them and then becomes it */
+		argv = []string{"gproc", "-rlimit=" + formatRlimits(req.Rlimits)}
+		if cg != nil {
+			argv = append(argv, "-cgroupJoin="+cg.dir)
+		}
+		if runAs {
+			argv = append(argv, "-runAs="+formatCredentials(req.Uid, req.Gid, req.Groups))
+		}
+		/*
+		 * the helper runs as us until it has become the user, so it
+		 * gets none of the job's environment, LD_PRELOAD and all;
+		 * it reads that from fd 3 and hands it to the program
+		 */
+		var envr *os.File
+		if err == nil {
+			envr, envw, err = os.Pipe()
+		}
+		if err == nil {
+			argv = append(argv, "-envFd=3")
+			procattr.Env = []string{}
+			procattr.Files = append(procattr.Files, envr)
+			defer envr.Close()
+		}
+		argv = append(append(argv, "L", execpath), req.Args...)
+		execpath = helperPath()
+	}
+	var p *os.Process
+	start := time.Now()
+	if err == nil {
+		p, err = os.StartProcess(execpath, argv, &procattr)
+	}
+	if envw != nil {
+		if err == nil {
+			go func() {
+				envw.Write([]byte(strings.Join(Env, "\x00")))
+				envw.Close()
+			}()
+		} else {
+			envw.Close()
+		}
+	}
+	if err != nil {
+		log_info("run: ", err)
+		stderr.Write([]uint8(err.Error() + "\n"))
+	}
+	stdin.Close()
+	stdout.Close()
+	stderr.Close()
+	if err != nil {
+		if cg != nil {
+			cg.Remove()
+		}
+		done <- &exitStatus{Err: err.Error(), Start: start, End: time.Now()}
+		return
+	}
+	lp.started(p)
+	if req.TimeLimit > 0 {
+		lp.timeLimit(req.TimeLimit, req.KillGrace)
+	}
+	w, timedOut, err := lp.wait()
+	var status *exitStatus
 	if err != nil {
-		log_error("run: ", err)
-		n.Write([]uint8(err.Error()))
+		status = &exitStatus{Err: err.Error(), TimedOut: timedOut}
 	} else {
-		w, _ := p.Wait()
 		log_info("run: process returned ", w.String())
+		status = newExitStatus(w)
+		status.TimedOut = timedOut
+		status.Limit = limitExceeded(req.Rlimits, w)
+	}
+	status.Start, status.End = start, time.Now()
+	if cg != nil {
+		/* whatever the program left behind goes with it */
+		cg.Kill()
+		status.MemPeak, status.CPUTime = cg.Usage()
+		if cg.OOMKilled() {
+			status.Limit = "memory"
+		}
+		cg.Remove()
 	}
-	done <- 1 // we're called as a goroutine, so notify that we're done
+	done <- status // we're called as a goroutine, so notify that we're done
 }
@@ -0,0 +1,105 @@
+/*
+ * gproc, a Go reimplementation of the LANL version of bproc and the LANL XCPU software.
+ *
+ * This software is released under the GNU Lesser General Public License, version 2, incorporated herein by reference.
+ *
+ * Copyright (2010) Sandia Corporation. Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+ * the U.S. Government retains certain rights in this software.
+ */
+
+/*
+ * Terminals, for "gproc e -tty". On the node, the slave gives the program
+ * a pseudo-terminal of its own, which is its stdin, stdout and stderr;
+ * whatever the program writes to it goes up as stdout, and our stdin and
+ * window size come down to it. Here, our own terminal is put in raw mode
+ * for as long as the program runs, so every keystroke, ^C included, goes
+ * to the program and not to us.
+ *
+ * Opening a pseudo-terminal and the ioctls for terminal modes differ from
+ * one OS to another, and live in bproc_$GOOS.go.
+ */
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+/* winsize is struct winsize from <sys/ioctl.h> */
+type winsize struct {
+	Rows, Cols     uint16
+	Xpixel, Ypixel uint16
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getWinsize(f *os.File) (rows, cols int, err error) {
+	var ws winsize
+	err = ioctl(f, syscall.TIOCGWINSZ, unsafe.Pointer(&ws))
+	return int(ws.Rows), int(ws.Cols), err
+}
+
+func setWinsize(f *os.File, rows, cols int) error {
+	ws := winsize{Rows: uint16(rows), Cols: uint16(cols)}
+	return ioctl(f, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+/* the modes our terminal had before makeRaw, if it has been called */
+var savedTermios *syscall.Termios
+
+/*
+ * makeRaw puts the terminal on f in raw mode, as cfmakeraw(3) does, and
+ * remembers how it was for restoreTerminal. It fails if f is not a terminal.
+ */
+func makeRaw(f *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(f, ioctlGetTermios, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	saved := t
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := ioctl(f, ioctlSetTermios, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	savedTermios = &saved
+	return nil
+}
+
+/* restoreTerminal puts our stdin's terminal back the way makeRaw found it. */
+func restoreTerminal() {
+	if savedTermios != nil {
+		ioctl(os.Stdin, ioctlSetTermios, unsafe.Pointer(savedTermios))
+		savedTermios = nil
+	}
+}
+
+/*
+ * relayWinsize sends our window size down to the program whenever it
+ * changes, so that full-screen programs redraw to fit.
+ */
+func relayWinsize(r *RpcClientServer) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	for _ = range sigs {
+		rows, cols, err := getWinsize(os.Stdin)
+		if err != nil {
+			continue
+		}
+		r.Send("relayWinsize", &ioMsg{Kind: ioWinsize, Rows: rows, Cols: cols})
+	}
+}
@@ -88,10 +88,7 @@ func Status(w http.ResponseWriter, httpReq *http.Request) {
 
 func ExtendedSlaveInformation(w http.ResponseWriter, req *http.Request) {
 	// Get the list of servers
-	var slavesOut []SlaveInfo
-	for _, i := range slaves.Slaves {
-		slavesOut = append(slavesOut, *i)
-	}
+	slavesOut := slaves.List()
 	data := map[string]interface{}{
 		"title":     "Extended Slave Information",
 		"slavesOut": slavesOut,
@@ -0,0 +1,208 @@
+package nodespec
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Hosts is a set of host names in the notation of Slurm's hostlists: a
+// prefix, optionally followed by a list of number ranges in brackets and
+// a suffix. kn[1-3,7]-ib is kn1-ib, kn2-ib, kn3-ib and kn7-ib; sb12, with
+// no brackets, is just sb12. A range whose first number has a leading
+// zero is zero-padded to that many digits, so kn[08-10] is kn08, kn09 and
+// kn10, but not kn8.
+type Hosts struct {
+	Prefix, Suffix string
+	Ranges         []Set // none for a single name
+}
+
+/* hosts reads a <hosts>, at a letter */
+func (p *parser) hosts() (*Hosts, error) {
+	h := &Hosts{Prefix: p.name()}
+	if p.peek() != '[' {
+		return h, nil
+	}
+	p.pos++
+	for {
+		p.skipBlanks()
+		width := 0
+		for p.pos+width < len(p.s) && isDigit(p.s[p.pos+width]) {
+			width++
+		}
+		padded := width > 1 && p.s[p.pos] == '0'
+		r, err := p.numbers("a number")
+		if err != nil {
+			return nil, err
+		}
+		if padded {
+			r.Width = width
+		}
+		h.Ranges = append(h.Ranges, r)
+		switch p.skipBlanks(); p.peek() {
+		case ',':
+			p.pos++
+			continue
+		case ']':
+			p.pos++
+		default:
+			return nil, p.errorf(p.pos, "want , or ], not %s", p.next())
+		}
+		break
+	}
+	h.Suffix = p.name()
+	if p.peek() == '[' {
+		return nil, p.errorf(p.pos, "only one [ ] to a host name")
+	}
+	return h, nil
+}
+
+/* name reads the letters, digits, -, _ and . of a host name */
+func (p *parser) name() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if !isLetter(c) && !isDigit(c) && c != '-' && c != '_' && c != '.' {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+/* pad writes n zero-padded to width digits */
+func pad(n, width int) string {
+	return fmt.Sprintf("%0*d", width, n)
+}
+
+// Contains says whether the set has the given host name in it. Case does
+// not matter, and neither does the domain: kn7 is kn7.cluster.example.
+func (h *Hosts) Contains(name string) bool {
+	if h.contains(name) {
+		return true
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		return h.contains(name[0:i])
+	}
+	return false
+}
+
+func (h *Hosts) contains(name string) bool {
+	if len(h.Ranges) == 0 {
+		return strings.EqualFold(name, h.Prefix)
+	}
+	n := len(name) - len(h.Suffix)
+	if n < len(h.Prefix) || !strings.EqualFold(name[0:len(h.Prefix)], h.Prefix) || !strings.EqualFold(name[n:], h.Suffix) {
+		return false
+	}
+	digits := name[len(h.Prefix):n]
+	v, err := strconv.Atoi(digits)
+	if err != nil || digits[0] == '+' || digits[0] == '-' {
+		return false
+	}
+	for _, r := range h.Ranges {
+		if pad(v, r.Width) == digits && r.First <= v && v <= r.Last && (v-r.First)%r.Step == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hosts) String() string {
+	if len(h.Ranges) == 0 {
+		return h.Prefix
+	}
+	r := []string{}
+	for _, s := range h.Ranges {
+		r = append(r, s.String())
+	}
+	return h.Prefix + "[" + strings.Join(r, ",") + "]" + h.Suffix
+}
+
+// FormatHosts writes a list of host names in the notation Parse reads,
+// as compactly as it can: kn1, kn2, kn3, kn7 and sb12 come out as
+// kn[1-3,7],sb12. The names keep the order they were first seen in, as
+// far as their prefixes let them; duplicates are dropped.
+func FormatHosts(names []string) string {
+	type group struct {
+		prefix string
+		width  int
+		nums   []int
+	}
+	/* a name's number is the digits it ends with */
+	split := func(name string) (prefix, digits string) {
+		i := len(name)
+		for i > 0 && isDigit(name[i-1]) {
+			i--
+		}
+		return name[0:i], name[i:]
+	}
+	/* kn09 makes kn[08-10] zero-padded to 2 digits, and kn10 fits in with it */
+	padded := make(map[string]bool)
+	for _, name := range names {
+		prefix, digits := split(name)
+		if len(digits) > 1 && digits[0] == '0' {
+			padded[fmt.Sprint(prefix, "/", len(digits))] = true
+		}
+	}
+	var out []interface{}
+	groups := make(map[string]*group)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		prefix, digits := split(name)
+		n, err := strconv.Atoi(digits)
+		if digits == "" || err != nil {
+			if !seen[name] {
+				seen[name] = true
+				out = append(out, name)
+			}
+			continue
+		}
+		width := 0
+		if padded[fmt.Sprint(prefix, "/", len(digits))] {
+			width = len(digits)
+		}
+		key := fmt.Sprint(prefix, "/", width)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{prefix: prefix, width: width}
+			groups[key] = g
+			out = append(out, g)
+		}
+		g.nums = append(g.nums, n)
+	}
+	l := []string{}
+	for _, o := range out {
+		g, ok := o.(*group)
+		if !ok {
+			l = append(l, o.(string))
+			continue
+		}
+		sort.Ints(g.nums)
+		r := []string{}
+		for i := 0; i < len(g.nums); {
+			j := i + 1
+			for j < len(g.nums) && g.nums[j]-g.nums[j-1] <= 1 {
+				j++
+			}
+			s := Set{First: g.nums[i], Last: g.nums[j-1], Step: 1, Width: g.width}
+			r = append(r, s.String())
+			i = j
+		}
+		if len(r) == 1 && !strings.Contains(r[0], "-") {
+			l = append(l, g.prefix+r[0])
+		} else {
+			l = append(l, g.prefix+"["+strings.Join(r, ",")+"]")
+		}
+	}
+	return strings.Join(l, ",")
+}
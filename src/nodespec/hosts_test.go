@@ -0,0 +1,133 @@
+package nodespec
+
+import (
+	"testing"
+)
+
+var hostParseTests = []struct {
+	in, out string
+}{
+	{"sb12", "sb12"},
+	{"kn[1-20,30]", "kn[1-20,30]"},
+	{"kn[1-20,30],sb[1-49]", "kn[1-20,30],sb[1-49]"},
+	{"kn[ 1 - 4 ]-ib", "kn[1-4]-ib"},
+	{"kn[01-10]", "kn[01-10]"},
+	{"kn[1-64:4]", "kn[1-64:4]"},
+	{"kn7/.", "kn7/."},
+	{"1/kn7", "1/kn7"},
+	{"1-10,^kn[3-4]", "1-10,^kn[3-4]"},
+	{"node-1.example", "node-1.example"},
+}
+
+func TestParseHosts(t *testing.T) {
+	for _, tt := range hostParseTests {
+		s, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if s.String() != tt.out {
+			t.Errorf("Parse(%q) = %q, want %q", tt.in, s.String(), tt.out)
+		}
+	}
+}
+
+var hostErrorTests = []struct {
+	in  string
+	pos int
+	msg string
+}{
+	{"kn[", 3, "want a number, not the end"},
+	{"kn[1-4", 6, "want , or ], not the end"},
+	{"kn[1-4]x[1-2]", 8, "only one [ ] to a host name"},
+	{"kn[a]", 3, `want a number, not "a"`},
+}
+
+func TestHostErrors(t *testing.T) {
+	for _, tt := range hostErrorTests {
+		_, err := Parse(tt.in)
+		se, ok := err.(*SyntaxError)
+		switch {
+		case !ok:
+			t.Errorf("Parse(%q): got %v, want a SyntaxError", tt.in, err)
+		case se.Pos != tt.pos || se.Msg != tt.msg:
+			t.Errorf("Parse(%q): got %q at %d, want %q at %d", tt.in, se.Msg, se.Pos, tt.msg, tt.pos)
+		}
+	}
+}
+
+var containsTests = []struct {
+	hosts, name string
+	contains    bool
+}{
+	{"sb12", "sb12", true},
+	{"sb12", "SB12", true},
+	{"sb12", "sb12.cluster.example", true},
+	{"sb12", "sb1", false},
+	{"kn[1-20,30]", "kn20", true},
+	{"kn[1-20,30]", "kn21", false},
+	{"kn[1-20,30]", "kn30", true},
+	{"kn[1-20,30]", "kn", false},
+	{"kn[1-20,30]", "kn05", false},
+	{"kn[01-10]", "kn05", true},
+	{"kn[01-10]", "kn5", false},
+	{"kn[01-10]", "kn10", true},
+	{"kn[1-4]-ib", "kn3-ib", true},
+	{"kn[1-4]-ib", "kn3", false},
+	{"kn[1-9:2]", "kn4", false},
+	{"kn[1-9:2]", "kn5", true},
+}
+
+func TestContains(t *testing.T) {
+	for _, tt := range containsTests {
+		s, err := Parse(tt.hosts)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.hosts, err)
+		}
+		if s[0].Path[0].Hosts.Contains(tt.name) != tt.contains {
+			t.Errorf("%q.Contains(%q) = %v, want %v", tt.hosts, tt.name, !tt.contains, tt.contains)
+		}
+	}
+}
+
+var formatTests = []struct {
+	in  []string
+	out string
+}{
+	{[]string{}, ""},
+	{[]string{"kn1"}, "kn1"},
+	{[]string{"kn1", "kn2", "kn3", "kn7", "sb12"}, "kn[1-3,7],sb12"},
+	{[]string{"sb12", "kn3", "kn1", "kn2", "kn2"}, "sb12,kn[1-3]"},
+	{[]string{"kn08", "kn09", "kn10", "kn11"}, "kn[08-11]"},
+	{[]string{"kn8", "kn09"}, "kn8,kn09"},
+	{[]string{"login", "login", "kn1"}, "login,kn1"},
+	{[]string{"rack1-n1", "rack1-n2", "rack2-n1"}, "rack1-n[1-2],rack2-n1"},
+}
+
+func TestFormatHosts(t *testing.T) {
+	for _, tt := range formatTests {
+		out := FormatHosts(tt.in)
+		if out != tt.out {
+			t.Errorf("FormatHosts(%q) = %q, want %q", tt.in, out, tt.out)
+			continue
+		}
+		if out == "" {
+			continue
+		}
+		/* and back again */
+		s, err := Parse(out)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", out, err)
+			continue
+		}
+		for _, name := range tt.in {
+			found := false
+			for _, term := range s {
+				found = found || term.Path[0].Hosts.Contains(name)
+			}
+			if !found {
+				t.Errorf("Parse(%q) does not contain %q", out, name)
+			}
+		}
+	}
+}
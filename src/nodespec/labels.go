@@ -0,0 +1,151 @@
+package nodespec
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Labels picks nodes by the labels they carry, key=value pairs such as
+// arch=arm or rack=3: @arch=arm,rack=3 is the nodes whose arch is arm
+// and whose rack is 3. A label with no operator and value, as in @gpu,
+// asks only that the node has the label. The ordering operators compare
+// numbers, which may have a K, M, G or T suffix, in powers of 1024:
+// @mem>=8G. So do = and != when both sides are numbers, so that mem=8G
+// is mem=8192M.
+//
+// After a comma, a label with no operator is taken for a host name
+// instead: @rack=3,gpu is the nodes in rack 3, and the node called gpu.
+// Put such labels first, as in @gpu,rack=3.
+type Labels []Label
+
+// A Label is one of the tests of a Labels.
+type Label struct {
+	Key, Op, Value string // Op and Value are empty to ask only for the key
+}
+
+/* labels reads a <labels>, after the @ */
+func (p *parser) labels() (Labels, error) {
+	l := Labels{}
+	comma := 0
+	for {
+		p.skipBlanks()
+		start := p.pos
+		key := p.name()
+		p.skipBlanks()
+		op := p.op()
+		switch {
+		case op == "" && len(l) > 0:
+			/* not ours: the start of the next term */
+			p.pos = comma
+			return l, nil
+		case key == "":
+			p.pos = start
+			return nil, p.errorf(start, "want a label, not %s", p.next())
+		}
+		value := ""
+		if op != "" {
+			p.skipBlanks()
+			if value = p.name(); value == "" {
+				return nil, p.errorf(p.pos, "want a value for %s, not %s", key, p.next())
+			}
+			if _, ok := parseNumber(value); !ok && op != "=" && op != "!=" {
+				return nil, p.errorf(p.pos-len(value), "%s %s wants a number, not %s", key, op, value)
+			}
+		}
+		l = append(l, Label{Key: key, Op: op, Value: value})
+		if p.skipBlanks(); p.peek() != ',' {
+			return l, nil
+		}
+		comma = p.pos
+		p.pos++
+	}
+}
+
+/* op reads a comparison operator, if there is one */
+func (p *parser) op() string {
+	for _, op := range []string{"!=", "<=", ">=", "=", "<", ">"} {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+/* parseNumber parses a number with an optional K, M, G or T suffix */
+func parseNumber(s string) (float64, bool) {
+	mult := 1.0
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		mult = 1 << 10
+	case 'm', 'M':
+		mult = 1 << 20
+	case 'g', 'G':
+		mult = 1 << 30
+	case 't', 'T':
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		s = s[0 : len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v * mult, err == nil
+}
+
+// Matches says whether a node with the given labels is one of the set.
+func (l Labels) Matches(labels map[string]string) bool {
+	for _, t := range l {
+		v, ok := labels[t.Key]
+		if t.Op == "" {
+			if !ok {
+				return false
+			}
+			continue
+		}
+		if !ok || v == "" {
+			if t.Op != "!=" {
+				return false
+			}
+			continue
+		}
+		if !compare(v, t.Op, t.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func compare(v, op, want string) bool {
+	x, xok := parseNumber(v)
+	y, yok := parseNumber(want)
+	if !xok || !yok {
+		switch op {
+		case "=":
+			return v == want
+		case "!=":
+			return v != want
+		}
+		return false
+	}
+	switch op {
+	case "=":
+		return x == y
+	case "!=":
+		return x != y
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	case ">":
+		return x > y
+	}
+	return x >= y
+}
+
+func (l Labels) String() string {
+	s := []string{}
+	for _, t := range l {
+		s = append(s, t.Key+t.Op+t.Value)
+	}
+	return "@" + strings.Join(s, ",")
+}
@@ -0,0 +1,59 @@
+package nodespec
+
+import (
+	"testing"
+)
+
+var labelParseTests = []struct {
+	in, out string
+}{
+	{"@arch=arm", "@arch=arm"},
+	{"@arch=arm,rack=3", "@arch=arm,rack=3"},
+	{"@ arch = arm , rack = 3", "@arch=arm,rack=3"},
+	{"@mem>=8G", "@mem>=8G"},
+	{"@gpu", "@gpu"},
+	{"@gpu,rack!=3", "@gpu,rack!=3"},
+	{"@rack=3,gpu", "@rack=3,gpu"},
+	{"@rack=3,5,^7", "@rack=3,5,^7"},
+	{"@rack=3,.", "@rack=3,."},
+	{"1/@arch=arm/.", "1/@arch=arm/."},
+	{"^@rack=3", "^@rack=3"},
+}
+
+func TestParseLabels(t *testing.T) {
+	for _, tt := range labelParseTests {
+		s, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if s.String() != tt.out {
+			t.Errorf("Parse(%q) = %q, want %q", tt.in, s.String(), tt.out)
+		}
+	}
+}
+
+var labelErrorTests = []struct {
+	in  string
+	pos int
+	msg string
+}{
+	{"@", 1, "want a label, not the end"},
+	{"@=3", 1, `want a label, not "="`},
+	{"@arch=", 6, "want a value for arch, not the end"},
+	{"@mem>=lots", 6, "mem >= wants a number, not lots"},
+	{"@arch=arm,=3", 10, `want a label, not "="`},
+}
+
+func TestLabelErrors(t *testing.T) {
+	for _, tt := range labelErrorTests {
+		_, err := Parse(tt.in)
+		se, ok := err.(*SyntaxError)
+		switch {
+		case !ok:
+			t.Errorf("Parse(%q): got %v, want a SyntaxError", tt.in, err)
+		case se.Pos != tt.pos || se.Msg != tt.msg:
+			t.Errorf("Parse(%q): got %q at %d, want %q at %d", tt.in, se.Msg, se.Pos, tt.msg, tt.pos)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+// Package nodespec parses the node specifications gproc uses to pick
+// nodes out of its tree of them:
+//
+//	<spec> ::= "" | <term> | <term> "," <spec>
+//	<term> ::= <path> | "^" <path> | "#" <num> [ <pool> ]
+//	<pool> ::= <hosts> | "@" <labels> | "%" <name>
+//	<path> ::= <set> | <set> "/" <path> | "%" <name> | "%" <name> "/" <path>
+//	<set>  ::= "." | <range> | <hosts> | "@" <labels>
+//	<range> ::= <num> | <num> "-" <num> | <num> "-" <num> ":" <num>
+//	<hosts> ::= <name> | <name> "[" <ranges> "]" [ <name> ]
+//	<ranges> ::= <range> | <range> "," <ranges>
+//	<labels> ::= <label> | <label> "," <labels>
+//	<label> ::= <name> | <name> <op> <value>
+//	<op> ::= "=" | "!=" | "<" | "<=" | ">" | ">="
+//
+// A path names the nodes at its end: 3/5 is node 5 under node 3. Commas
+// bind loosest, so 1-2,3/1-3 is nodes 1 and 2, and nodes 1 to 3 under
+// node 3. "." is every node at its level, and a-b:s every s'th node from
+// a to b. A term starting with ^ takes the nodes it names, and all the
+// nodes under them, out again: 1-100,^17,^40-45 is 1 to 100 less 17 and
+// 40 to 45. Blanks between the tokens are ignored.
+//
+// Nodes may also be named by host name, as Slurm does: kn[1-20,30] is
+// kn1 to kn20 and kn30, and kn[01-20] is kn01 to kn20; or picked by the
+// labels they carry: @arch=arm,rack=3 is the nodes whose arch is arm and
+// whose rack is 3. Unlike numbers, which name nodes at one level, these
+// name nodes anywhere under where they stand: kn7/. is the node called
+// kn7, wherever it is, and every node under it, and 1/@mem>=8G every node
+// under node 1 with 8G of memory or more. See Hosts, Labels and Resolve.
+//
+// Last, %name stands for the nodes of a named group, which Resolve is
+// given the specs of. It names the nodes at the ends of the group's
+// paths, and, since a group is defined from the top of the tree, only
+// starts a path: if rack1 is 1-7/1-6, %rack1/. is every node under
+// those.
+//
+// A term #n leaves it to Resolve to pick n nodes that are not busy, from
+// the pool given, if any: #32@arch=arm is any 32 idle arm nodes.
+package nodespec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Set is the nodes a path names at one level of the tree.
+type Set struct {
+	All               bool   // "."; the rest is unused
+	Hosts             *Hosts // host names; the rest is unused
+	Labels            Labels // labels; the rest is unused
+	Group             string // a named group; the rest is unused
+	First, Last, Step int
+	Width             int // in a host name, the digits are zero-padded to this many
+}
+
+// A Term is one of the comma-separated parts of a spec.
+type Term struct {
+	Exclude bool
+	Path    []Set
+	Count   int // for #n, n; the Path is the pool, if any
+}
+
+// A Spec is a parsed node specification.
+type Spec []Term
+
+// A SyntaxError reports a malformed spec, and where in it the trouble is.
+type SyntaxError struct {
+	Spec string
+	Pos  int // byte offset in Spec
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("node spec %q at %d: %s", e.Spec, e.Pos, e.Msg)
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+// Parse parses a node specification. The empty string is a spec that
+// names no nodes.
+func Parse(s string) (Spec, error) {
+	p := &parser{s: s}
+	spec := Spec{}
+	if p.skipBlanks(); p.pos == len(s) {
+		return spec, nil
+	}
+	for {
+		t, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		spec = append(spec, t)
+		switch p.skipBlanks(); {
+		case p.pos == len(s):
+			return spec, nil
+		case s[p.pos] != ',':
+			return nil, p.errorf(p.pos, "want , or the end, not %s", p.next())
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) term() (t Term, err error) {
+	if p.skipBlanks(); p.peek() == '^' {
+		t.Exclude = true
+		p.pos++
+	}
+	if p.skipBlanks(); p.peek() == '#' {
+		if t.Exclude {
+			return t, p.errorf(p.pos, "a count can not be taken out")
+		}
+		return p.count()
+	}
+	for {
+		var set Set
+		start := p.pos
+		if set, err = p.set(); err != nil {
+			return
+		}
+		if set.Group != "" && len(t.Path) > 0 {
+			return t, p.errorf(start, "a group must start its path")
+		}
+		t.Path = append(t.Path, set)
+		if p.skipBlanks(); p.peek() != '/' {
+			return
+		}
+		p.pos++
+	}
+}
+
+/* count reads a #n term and its pool */
+func (p *parser) count() (t Term, err error) {
+	p.pos++
+	start := p.pos
+	if t.Count, err = p.number("a number of nodes"); err != nil {
+		return
+	}
+	if t.Count == 0 {
+		return t, p.errorf(start, "a count of 0")
+	}
+	p.skipBlanks()
+	if c := p.peek(); c == '@' || c == '%' || isLetter(c) {
+		var set Set
+		if set, err = p.set(); err != nil {
+			return
+		}
+		t.Path = []Set{set}
+	}
+	return
+}
+
+func (p *parser) set() (set Set, err error) {
+	switch p.skipBlanks(); {
+	case p.peek() == '.':
+		p.pos++
+		return Set{All: true}, nil
+	case isLetter(p.peek()):
+		set.Hosts, err = p.hosts()
+		return
+	case p.peek() == '@':
+		p.pos++
+		set.Labels, err = p.labels()
+		return
+	case p.peek() == '%':
+		p.pos++
+		if set.Group = p.name(); set.Group == "" {
+			err = p.errorf(p.pos, "want a group name, not %s", p.next())
+		}
+		return
+	}
+	return p.numbers("a node number, a host name or .")
+}
+
+/* numbers reads a <range>; 'want' says what it is for, should it not be there */
+func (p *parser) numbers(want string) (set Set, err error) {
+	start := p.pos
+	if set.First, err = p.number(want); err != nil {
+		return
+	}
+	set.Last, set.Step = set.First, 1
+	if p.skipBlanks(); p.peek() != '-' {
+		return
+	}
+	p.pos++
+	if set.Last, err = p.number("the number at the end of the range"); err != nil {
+		return
+	}
+	if set.Last < set.First {
+		return set, p.errorf(start, "range %d-%d ends before it starts", set.First, set.Last)
+	}
+	if p.skipBlanks(); p.peek() != ':' {
+		return
+	}
+	p.pos++
+	step := p.pos
+	if set.Step, err = p.number("a stride"); err != nil {
+		return
+	}
+	if set.Step == 0 {
+		return set, p.errorf(step, "a stride of 0")
+	}
+	return
+}
+
+/* number reads a number; 'want' says what it is for, should it not be there */
+func (p *parser) number(want string) (int, error) {
+	p.skipBlanks()
+	start := p.pos
+	for p.pos < len(p.s) && isDigit(p.s[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		return 0, p.errorf(start, "want %s, not %s", want, p.next())
+	}
+	n, err := strconv.Atoi(p.s[start:p.pos])
+	if err != nil {
+		return 0, p.errorf(start, "%s is too big", p.s[start:p.pos])
+	}
+	return n, nil
+}
+
+func (p *parser) skipBlanks() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *parser) peek() byte {
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+/* next describes what is at pos, for an error message */
+func (p *parser) next() string {
+	if p.pos == len(p.s) {
+		return "the end"
+	}
+	return strconv.Quote(p.s[p.pos : p.pos+1])
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return &SyntaxError{Spec: p.s, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Contains says whether the set names the node with the given id.
+// A set of host names, labels or a group contains no node ids; Resolve
+// them first.
+func (s Set) Contains(id string) bool {
+	switch {
+	case s.All:
+		return true
+	case s.search():
+		return false
+	}
+	n, err := strconv.Atoi(id)
+	return err == nil && s.First <= n && n <= s.Last && (n-s.First)%s.Step == 0
+}
+
+func (s Set) String() string {
+	switch {
+	case s.All:
+		return "."
+	case s.Hosts != nil:
+		return s.Hosts.String()
+	case s.Labels != nil:
+		return s.Labels.String()
+	case s.Group != "":
+		return "%" + s.Group
+	case s.First == s.Last:
+		return pad(s.First, s.Width)
+	case s.Step > 1:
+		return pad(s.First, s.Width) + "-" + pad(s.Last, s.Width) + ":" + strconv.Itoa(s.Step)
+	}
+	return pad(s.First, s.Width) + "-" + pad(s.Last, s.Width)
+}
+
+func (t Term) String() string {
+	p := []string{}
+	for _, s := range t.Path {
+		p = append(p, s.String())
+	}
+	switch {
+	case t.Exclude:
+		return "^" + strings.Join(p, "/")
+	case t.Count > 0:
+		return "#" + strconv.Itoa(t.Count) + strings.Join(p, "/")
+	}
+	return strings.Join(p, "/")
+}
+
+// String writes the spec out again, in a form Parse reads back.
+func (s Spec) String() string {
+	t := []string{}
+	for _, term := range s {
+		t = append(t, term.String())
+	}
+	return strings.Join(t, ",")
+}
+
+// Child applies the spec to a node at its top level, with the given id.
+// It says whether the node is to run the job, which every node along a
+// path does -- 3/5 runs it on node 3 as well as 3/5 -- and returns the
+// spec the node is to apply in turn to the nodes under it.
+func (s Spec) Child(id string) (runs bool, sub Spec) {
+	for _, t := range s {
+		if t.Count > 0 || !t.Path[0].Contains(id) {
+			continue
+		}
+		if t.Exclude && len(t.Path) == 1 {
+			return false, nil
+		}
+		if !t.Exclude {
+			runs = true
+		}
+		if len(t.Path) > 1 {
+			sub = append(sub, Term{Exclude: t.Exclude, Path: t.Path[1:]})
+		}
+	}
+	if !runs {
+		return false, nil
+	}
+	return true, sub
+}
+
+// Names says whether the spec names the node with the given full id,
+// such as 3/5: whether the node is at the end of one of its paths, and
+// not taken out again. Unlike Child, it does not count the nodes along
+// the way: 3/5 names 3/5 but not 3.
+func (s Spec) Names(id string) bool {
+	path := strings.Split(id, "/")
+	for _, n := range path[0 : len(path)-1] {
+		runs, sub := s.Child(n)
+		if !runs {
+			return false
+		}
+		s = sub
+	}
+	last := path[len(path)-1]
+	named := false
+	for _, t := range s {
+		if t.Count == 0 && len(t.Path) == 1 && t.Path[0].Contains(last) {
+			if t.Exclude {
+				return false
+			}
+			named = true
+		}
+	}
+	return named
+}
@@ -0,0 +1,144 @@
+package nodespec
+
+import (
+	"testing"
+)
+
+var parseTests = []struct {
+	in, out string
+}{
+	{"", ""},
+	{"1", "1"},
+	{"1-80", "1-80"},
+	{"1-64:4", "1-64:4"},
+	{"1-1", "1"},
+	{".", "."},
+	{"./.", "./."},
+	{"1/.", "1/."},
+	{"1-2,3/1-3", "1-2,3/1-3"},
+	{"1-100,^17,^40-45", "1-100,^17,^40-45"},
+	{"1/.,^1/7", "1/.,^1/7"},
+	{" 1 - 3 , ^ 2 ", "1-3,^2"},
+	{"%rack1", "%rack1"},
+	{"%rack1/.,^%io-nodes", "%rack1/.,^%io-nodes"},
+	{"#32", "#32"},
+	{"# 4 @arch=arm,mem>=8G,1", "#4@arch=arm,mem>=8G,1"},
+	{"#4%rack1,#2kn[1-9]", "#4%rack1,#2kn[1-9]"},
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range parseTests {
+		s, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if s.String() != tt.out {
+			t.Errorf("Parse(%q) = %q, want %q", tt.in, s.String(), tt.out)
+		}
+	}
+}
+
+var errorTests = []struct {
+	in  string
+	pos int
+	msg string
+}{
+	{"-1", 0, `want a node number, a host name or ., not "-"`},
+	{"1-b", 2, `want the number at the end of the range, not "b"`},
+	{"1-", 2, "want the number at the end of the range, not the end"},
+	{"5-3", 0, "range 5-3 ends before it starts"},
+	{"1,,2", 2, `want a node number, a host name or ., not ","`},
+	{"1,", 2, "want a node number, a host name or ., not the end"},
+	{"1/", 2, "want a node number, a host name or ., not the end"},
+	{"1-8:0", 4, "a stride of 0"},
+	{"1-8:x", 4, `want a stride, not "x"`},
+	{"1 2", 2, `want , or the end, not "2"`},
+	{"^", 1, "want a node number, a host name or ., not the end"},
+	{"99999999999999999999", 0, "99999999999999999999 is too big"},
+	{"%", 1, "want a group name, not the end"},
+	{"1/%rack1", 2, "a group must start its path"},
+	{"#", 1, "want a number of nodes, not the end"},
+	{"#0", 1, "a count of 0"},
+	{"^#4", 1, "a count can not be taken out"},
+	{"#4/1", 2, `want , or the end, not "/"`},
+}
+
+func TestErrors(t *testing.T) {
+	for _, tt := range errorTests {
+		_, err := Parse(tt.in)
+		se, ok := err.(*SyntaxError)
+		switch {
+		case !ok:
+			t.Errorf("Parse(%q): got %v, want a SyntaxError", tt.in, err)
+		case se.Pos != tt.pos || se.Msg != tt.msg:
+			t.Errorf("Parse(%q): got %q at %d, want %q at %d", tt.in, se.Msg, se.Pos, tt.msg, tt.pos)
+		}
+	}
+}
+
+var childTests = []struct {
+	spec, id string
+	runs     bool
+	sub      string
+}{
+	{"1-3", "2", true, ""},
+	{"1-3", "4", false, ""},
+	{"1-64:4", "5", true, ""},
+	{"1-64:4", "6", false, ""},
+	{".", "anything", true, ""},
+	{"1/3,1/4", "1", true, "3,4"},
+	{"1-100,^17", "17", false, ""},
+	{"1-100,^40-45", "44", false, ""},
+	{"1/.,^1/7", "1", true, ".,^7"},
+	{"^3/5", "3", false, ""},
+	{"./.", "7", true, "."},
+	{"#4,7", "7", true, ""},
+	{"#4", "7", false, ""},
+}
+
+func TestChild(t *testing.T) {
+	for _, tt := range childTests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.spec, err)
+		}
+		runs, sub := s.Child(tt.id)
+		if runs != tt.runs || sub.String() != tt.sub {
+			t.Errorf("%q.Child(%q) = %v, %q; want %v, %q", tt.spec, tt.id, runs, sub.String(), tt.runs, tt.sub)
+		}
+	}
+}
+
+var namesTests = []struct {
+	spec, id string
+	names    bool
+}{
+	{"3/5", "3/5", true},
+	{"3/5", "3", false},
+	{"3/5", "3/6", false},
+	{"1-2,3/1-3", "3/2", true},
+	{"1-2,3/1-3", "2", true},
+	{"1-2,3/1-3", "3", false},
+	{"1-100,^17,^40-45", "17", false},
+	{"1-100,^17,^40-45", "46", true},
+	{"./.", "3/9", true},
+	{"./.", "3", false},
+	{"1/.,^1/7", "1/7", false},
+	{"1/.,^1/7", "1/8", true},
+	{"1/.,^1", "1/8", false},
+	{"#4,1", "1", true},
+	{"#4", "1", false},
+}
+
+func TestNames(t *testing.T) {
+	for _, tt := range namesTests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.spec, err)
+		}
+		if s.Names(tt.id) != tt.names {
+			t.Errorf("%q.Names(%q) = %v, want %v", tt.spec, tt.id, !tt.names, tt.names)
+		}
+	}
+}
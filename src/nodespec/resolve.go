@@ -0,0 +1,317 @@
+package nodespec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Node is what Resolve needs to know of a node in the tree: its id
+// among its siblings, its host name and labels, whether it is busy, and
+// the nodes under it.
+type Node struct {
+	Id       string
+	Host     string
+	Labels   map[string]string
+	Busy     bool // Resolve does not pick busy nodes for a count
+	Children []Node
+}
+
+/* search says whether the set names nodes by host name, label or group, rather than by id */
+func (s Set) search() bool {
+	return s.Hosts != nil || s.Labels != nil || s.Group != ""
+}
+
+/* a resolver resolves specs against one tree and set of groups */
+type resolver struct {
+	tree    []Node
+	groups  map[string]Spec
+	members map[string]map[string]bool /* by group, the full ids of its nodes */
+	busy    map[string]bool            /* the groups being resolved, to catch loops */
+	taken   map[string]bool            /* the nodes counts have picked so far, or the rest of the spec runs on */
+	out     map[string]bool            /* the nodes the spec takes out, which counts must not pick */
+}
+
+// Resolve replaces the host names, labels and groups in a spec with the
+// ids of the nodes they name, given the tree of nodes and the specs of
+// the groups by name. A set of them names the nodes that match it
+// anywhere under where it stands in its path, and the rest of the path
+// goes on from each of them: if kn7 is node 3/5, kn7/1-2 becomes
+// 3/5/1-2, and 3/@gpu names every node under node 3 with a gpu label.
+// Sets that match no nodes name none. A group that is not in groups, or
+// that takes in itself, is an error, as are node ids other than numbers,
+// which a spec cannot name.
+//
+// For a count, #n, Resolve picks n nodes that are not busy and are in
+// the pool, if there is one, spreading them across the tree: one from
+// each subtree in turn, top level first, and a node before the nodes
+// under it. Since every node along the way to a node runs the job too,
+// the nodes above a node must be idle for it to be picked; with no pool
+// they are picked first, so the n nodes are all the nodes the job runs
+// on. A count adds that many nodes to the rest of the spec: it does not
+// pick the nodes the rest runs on, nor those it takes out, nor those
+// another count has picked, so #2,^1 picks two nodes other than node 1
+// and those under it. Too few idle nodes is an error.
+func (s Spec) Resolve(tree []Node, groups map[string]Spec) (Spec, error) {
+	r := &resolver{tree: tree, groups: groups, members: make(map[string]map[string]bool), busy: make(map[string]bool),
+		taken: make(map[string]bool), out: make(map[string]bool)}
+	return r.spec(s)
+}
+
+func (r *resolver) spec(s Spec) (Spec, error) {
+	/* the counts go last, so that they know what the rest of the spec has */
+	terms := make([][]Term, len(s))
+	rest := Spec{}
+	counts := false
+	for i, t := range s {
+		if len(t.Path) > 0 && t.Path[0].Group != "" {
+			if err := r.group(t.Path[0].Group); err != nil {
+				return nil, err
+			}
+		}
+		if t.Count > 0 {
+			counts = true
+			continue
+		}
+		paths, err := r.path(t.Path, "", r.tree)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			terms[i] = append(terms[i], Term{Exclude: t.Exclude, Path: p})
+		}
+		rest = append(rest, terms[i]...)
+	}
+	if counts {
+		r.claim(rest)
+	}
+	rs := Spec{}
+	for i, t := range s {
+		if t.Count > 0 {
+			paths, err := r.count(t)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range paths {
+				terms[i] = append(terms[i], Term{Path: p})
+			}
+		}
+		rs = append(rs, terms[i]...)
+	}
+	return rs, nil
+}
+
+/*
+ * claim marks the nodes a resolved spec runs the job on as taken, and
+ * those it takes out as out, so that counts pick neither.
+ */
+func (r *resolver) claim(s Spec) {
+	ex := Spec{}
+	for _, t := range s {
+		if t.Exclude {
+			ex = append(ex, Term{Path: t.Path})
+		}
+	}
+	var walk func(s Spec, parent string, nodes []Node)
+	walk = func(s Spec, parent string, nodes []Node) {
+		for i := range nodes {
+			n := &nodes[i]
+			fid := fullId(parent, n.Id)
+			if ex.Names(fid) {
+				r.out[fid] = true
+				continue
+			}
+			runs, sub := s.Child(n.Id)
+			if runs {
+				r.taken[fid] = true
+			}
+			walk(sub, fid, n.Children)
+		}
+	}
+	walk(s, "", r.tree)
+}
+
+/* group finds the members of a group, if it has not already */
+func (r *resolver) group(name string) error {
+	if _, ok := r.members[name]; ok {
+		return nil
+	}
+	g, ok := r.groups[name]
+	switch {
+	case !ok:
+		return fmt.Errorf("no group %s", name)
+	case r.busy[name]:
+		return fmt.Errorf("group %s takes in itself", name)
+	}
+	r.busy[name] = true
+	defer delete(r.busy, name)
+	gs, err := r.spec(g)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]bool)
+	var walk func(parent string, nodes []Node)
+	walk = func(parent string, nodes []Node) {
+		for _, n := range nodes {
+			fid := fullId(parent, n.Id)
+			if gs.Names(fid) {
+				m[fid] = true
+			}
+			walk(fid, n.Children)
+		}
+	}
+	walk("", r.tree)
+	r.members[name] = m
+	return nil
+}
+
+/* matches says whether a node, with the given full id, is one of a set of host names, labels or a group */
+func (r *resolver) matches(s Set, n *Node, fid string) bool {
+	switch {
+	case s.Hosts != nil:
+		return s.Hosts.Contains(n.Host)
+	case s.Labels != nil:
+		return s.Labels.Matches(n.Labels)
+	}
+	return r.members[s.Group][fid]
+}
+
+/*
+ * path resolves a path, or what is left of one, against the nodes at
+ * its level, the sub-nodes of the node with full id 'parent'.
+ */
+func (r *resolver) path(path []Set, parent string, nodes []Node) ([][]Set, error) {
+	if len(path) == 0 {
+		return [][]Set{{}}, nil
+	}
+	if !hasSearch(path) {
+		return [][]Set{path}, nil
+	}
+	paths := [][]Set{}
+	var walk func(prefix []Set, parent string, nodes []Node) error
+	walk = func(prefix []Set, parent string, nodes []Node) error {
+		for i := range nodes {
+			n := &nodes[i]
+			if !path[0].search() && !path[0].Contains(n.Id) {
+				continue
+			}
+			id, err := idSet(n)
+			if err != nil {
+				return err
+			}
+			p := concat(prefix, []Set{id})
+			fid := fullId(parent, n.Id)
+			if !path[0].search() || r.matches(path[0], n, fid) {
+				rest, err := r.path(path[1:], fid, n.Children)
+				if err != nil {
+					return err
+				}
+				for _, rp := range rest {
+					paths = append(paths, concat(p, rp))
+				}
+			}
+			/* host names, labels and groups look all the way down */
+			if path[0].search() {
+				if err := walk(p, fid, n.Children); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := walk(nil, parent, nodes)
+	return paths, err
+}
+
+/* count picks the nodes for a #n term */
+func (r *resolver) count(t Term) ([][]Set, error) {
+	pool := Set{All: true}
+	if len(t.Path) > 0 {
+		pool = t.Path[0]
+	}
+	idle := r.spread(pool, "", r.tree)
+	if len(idle) < t.Count {
+		return nil, fmt.Errorf("%s: only %d idle nodes", t, len(idle))
+	}
+	paths := [][]Set{}
+	for _, fid := range idle[0:t.Count] {
+		r.taken[fid] = true
+		p := []Set{}
+		for _, id := range strings.Split(fid, "/") {
+			set, err := idSet(&Node{Id: id})
+			if err != nil {
+				return nil, fmt.Errorf("node %s has an id that is not a number", fid)
+			}
+			p = append(p, set)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+/*
+ * spread lists the full ids of the idle nodes in a pool, under the node
+ * 'parent', in the order count picks them: each node before the nodes
+ * under it, and the subtrees taking turns. A busy node hides the nodes
+ * under it, which could not run the job without it, as does one the
+ * spec takes out; one that is taken already does not.
+ */
+func (r *resolver) spread(pool Set, parent string, nodes []Node) []string {
+	subtrees := [][]string{}
+	for i := range nodes {
+		n := &nodes[i]
+		fid := fullId(parent, n.Id)
+		if n.Busy || r.out[fid] {
+			continue
+		}
+		l := r.spread(pool, fid, n.Children)
+		if !r.taken[fid] && (pool.All || r.matches(pool, n, fid)) {
+			l = append([]string{fid}, l...)
+		}
+		if len(l) > 0 {
+			subtrees = append(subtrees, l)
+		}
+	}
+	l := []string{}
+	for i := 0; len(subtrees) > 0; i++ {
+		more := [][]string{}
+		for _, s := range subtrees {
+			if i < len(s) {
+				l = append(l, s[i])
+				more = append(more, s)
+			}
+		}
+		subtrees = more
+	}
+	return l
+}
+
+/* concat makes a new path of a followed by b */
+func concat(a, b []Set) []Set {
+	p := make([]Set, 0, len(a)+len(b))
+	return append(append(p, a...), b...)
+}
+
+func fullId(parent, id string) string {
+	if parent == "" {
+		return id
+	}
+	return parent + "/" + id
+}
+
+func hasSearch(path []Set) bool {
+	for _, s := range path {
+		if s.search() {
+			return true
+		}
+	}
+	return false
+}
+
+func idSet(n *Node) (Set, error) {
+	v, err := strconv.Atoi(n.Id)
+	if err != nil || strings.ContainsAny(n.Id, "+-") {
+		return Set{}, fmt.Errorf("node %s, called %s, has an id that is not a number", n.Id, n.Host)
+	}
+	return Set{First: v, Last: v, Step: 1}, nil
+}
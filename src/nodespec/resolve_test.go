@@ -0,0 +1,170 @@
+package nodespec
+
+import (
+	"testing"
+)
+
+var tree = []Node{
+	{Id: "1", Host: "kn1", Labels: map[string]string{"arch": "amd64", "mem": "16G", "rack": "1"}, Children: []Node{
+		{Id: "5", Host: "kn5", Labels: map[string]string{"arch": "arm", "mem": "4G", "rack": "1"}},
+		{Id: "6", Host: "kn6", Labels: map[string]string{"arch": "arm", "mem": "8G", "rack": "3", "gpu": ""}},
+	}},
+	{Id: "2", Host: "kn2", Labels: map[string]string{"arch": "amd64", "mem": "32G", "rack": "3"}},
+	{Id: "3", Host: "sb12.cluster", Labels: map[string]string{"arch": "arm", "rack": "3"}},
+}
+
+var groups = map[string]string{
+	"rack3":  "@rack=3",
+	"kn":     "kn[1-9]",
+	"under":  "1/.,^1/5",
+	"both":   "%rack3,%kn",
+	"loop":   "%loop2",
+	"loop2":  "1,%loop",
+	"nosuch": "%missing",
+}
+
+func parseGroups(t *testing.T) map[string]Spec {
+	g := make(map[string]Spec)
+	for name, spec := range groups {
+		s, err := Parse(spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", spec, err)
+		}
+		g[name] = s
+	}
+	return g
+}
+
+var resolveTests = []struct {
+	in, out string
+}{
+	{"kn[1-2]", "1,2"},
+	{"kn[5-6]", "1/5,1/6"},
+	{"kn[1-10]/.", "1/.,1/5/.,1/6/.,2/."},
+	{"./.,^kn5", "./.,^1/5"},
+	{"sb12,7", "3,7"},
+	{"kn99", ""},
+	{"1/kn[1-9]", "1/5,1/6"},
+	{"2/kn[1-9]", ""},
+	{"@arch=arm", "1/5,1/6,3"},
+	{"@arch=arm,rack=3", "1/6,3"},
+	{"@mem>=8G", "1,1/6,2"},
+	{"@mem>=8192M", "1,1/6,2"},
+	{"@mem<8G", "1/5"},
+	{"@mem=16384M", "1"},
+	{"@arch!=arm", "1,2"},
+	{"@gpu", "1/6"},
+	{"@gpu,rack=3", "1/6"},
+	{"@rack=1,sb12", "1,1/5,3"},
+	{"1/@arch=arm", "1/5,1/6"},
+	{"./@arch=arm", "1/5,1/6"},
+	{"@rack=3/.", "1/6/.,2/.,3/."},
+	{"./.,^@arch=arm", "./.,^1/5,^1/6,^3"},
+	{"1-2,5", "1-2,5"},
+	{"%rack3", "1/6,2,3"},
+	{"%rack3/.", "1/6/.,2/.,3/."},
+	{"%under", "1/6"},
+	{"%under/.", "1/6/."},
+	{"%both", "1,1/5,1/6,2,3"},
+	{"./.,^%kn", "./.,^1,^1/5,^1/6,^2"},
+}
+
+func TestResolve(t *testing.T) {
+	for _, tt := range resolveTests {
+		s, err := Parse(tt.in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.in, err)
+		}
+		r, err := s.Resolve(tree, parseGroups(t))
+		if err != nil {
+			t.Errorf("%q.Resolve: %v", tt.in, err)
+			continue
+		}
+		if r.String() != tt.out {
+			t.Errorf("%q.Resolve = %q, want %q", tt.in, r.String(), tt.out)
+		}
+	}
+	s, _ := Parse("kn1")
+	if _, err := s.Resolve([]Node{{Id: "x", Host: "kn1"}}, nil); err == nil {
+		t.Errorf("Resolve with a node id x: no error")
+	}
+}
+
+var groupErrorTests = []struct {
+	in, err string
+}{
+	{"%none", "no group none"},
+	{"%nosuch", "no group missing"},
+	{"%loop", "group loop takes in itself"},
+	{"2,%loop2/.", "group loop2 takes in itself"},
+}
+
+func TestGroupErrors(t *testing.T) {
+	for _, tt := range groupErrorTests {
+		s, err := Parse(tt.in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.in, err)
+		}
+		/* even with no nodes at all */
+		for _, tree := range [][]Node{tree, nil} {
+			_, err := s.Resolve(tree, parseGroups(t))
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q.Resolve: got %v, want %s", tt.in, err, tt.err)
+			}
+		}
+	}
+}
+
+var countTree = []Node{
+	{Id: "1", Host: "kn1", Children: []Node{
+		{Id: "5", Host: "kn5", Labels: map[string]string{"arch": "arm"}},
+		{Id: "6", Host: "kn6", Labels: map[string]string{"arch": "arm"}, Busy: true},
+		{Id: "7", Host: "kn7", Labels: map[string]string{"arch": "arm"}},
+	}},
+	{Id: "2", Host: "kn2", Children: []Node{
+		{Id: "1", Host: "kn21", Labels: map[string]string{"arch": "arm"}},
+	}},
+	{Id: "3", Host: "kn3", Busy: true, Children: []Node{
+		{Id: "1", Host: "kn31", Labels: map[string]string{"arch": "arm"}},
+	}},
+	{Id: "4", Host: "kn4", Labels: map[string]string{"arch": "arm"}},
+}
+
+var countTests = []struct {
+	in, out string
+}{
+	{"#1", "1"},
+	{"#3", "1,2,4"},
+	{"#5", "1,2,4,1/5,2/1"},
+	{"#6", "1,2,4,1/5,2/1,1/7"},
+	{"#2@arch=arm", "1/5,2/1"},
+	{"#4@arch=arm", "1/5,2/1,4,1/7"},
+	{"#2kn[4-7]", "1/5,4"},
+	{"#2,#2", "1,2,1/5,2/1"},
+	{"4,#1", "4,1"},
+	{"#2,^1", "2,4,^1"},
+	{"1,#2", "1,1/5,2"},
+	{"^1,#1", "^1,2"},
+	{"1/7,#2", "1/7,1/5,2"},
+	{"#4,^2/1", "1,2,4,1/5,^2/1"},
+	{"#5,^1", "#5: only 3 idle nodes"},
+	{"#7", "#7: only 6 idle nodes"},
+	{"#5@arch=arm", "#5@arch=arm: only 4 idle nodes"},
+}
+
+func TestCount(t *testing.T) {
+	for _, tt := range countTests {
+		s, err := Parse(tt.in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.in, err)
+		}
+		r, err := s.Resolve(countTree, nil)
+		out := r.String()
+		if err != nil {
+			out = err.Error()
+		}
+		if out != tt.out {
+			t.Errorf("%q.Resolve = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}